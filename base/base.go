@@ -1,6 +1,7 @@
 package base
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,12 +11,22 @@ import (
 )
 
 func ServerListen(port net.Listener) {
+	ServerListenWith(port, &DefaultDialOptions)
+}
+
+// ServerListenWith serves SOCKS5 on port, connecting to destinations with
+// opts. It returns once port is closed.
+func ServerListenWith(port net.Listener, opts *DialOptions) {
 	for {
 		conn, err := port.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Println("Failed to accept request:", err)
+			continue
 		}
-		go handleRequest(conn)
+		go handleRequest(conn, opts)
 	}
 }
 
@@ -123,16 +134,34 @@ func GetDest(client net.Conn) (atyp int, addr string, port uint16, e error) {
 	return
 }
 
+// ReplyCode maps a dial error to the SOCKS5 reply code reported for it.
+func ReplyCode(err error) byte {
+	var re ReplyError
+	if errors.As(err, &re) {
+		return byte(re)
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return 4
+	}
+	if strings.Contains(err.Error(), "connection refused") {
+		return 5
+	} else if strings.Contains(err.Error(), "lookup invalid") {
+		return 4
+	} else if strings.Contains(err.Error(), "network is unreachable") {
+		return 3
+	}
+	return 1
+}
+
 func TryDial(client net.Conn, destAddr string) (net.Conn, error) {
-	dest, err := net.Dial("tcp", destAddr)
+	return tryDial(client, destAddr, &DefaultDialOptions)
+}
+
+func tryDial(client net.Conn, destAddr string, opts *DialOptions) (net.Conn, error) {
+	dest, err := opts.Dial(context.Background(), destAddr)
 	if err != nil {
-		if strings.Contains(err.Error(), "connection refused") {
-			client.Write([]byte{5, 5})
-		} else if strings.Contains(err.Error(), "lookup invalid") {
-			client.Write([]byte{5, 4})
-		} else if strings.Contains(err.Error(), "network is unreachable") {
-			client.Write([]byte{5, 3})
-		}
+		client.Write([]byte{5, ReplyCode(err)})
 		return nil, errors.New(err.Error())
 	}
 	return dest, err
@@ -173,14 +202,14 @@ func Forward(client, target net.Conn) {
 	forwarding(target, client)
 }
 
-func handleRequest(conn net.Conn) {
+func handleRequest(conn net.Conn, opts *DialOptions) {
 	err := Auth(conn)
 	if err != nil {
 		fmt.Println("Authentication failed:", err)
 		conn.Close()
 		return
 	}
-	target, err := connect(conn)
+	target, err := connect(conn, opts)
 	if err != nil {
 		fmt.Println("Connection failed:", err)
 		conn.Close()
@@ -189,7 +218,7 @@ func handleRequest(conn net.Conn) {
 	Forward(conn, target)
 }
 
-func connect(client net.Conn) (net.Conn, error) {
+func connect(client net.Conn, opts *DialOptions) (net.Conn, error) {
 	aypt, addr, port, err := GetDest(client)
 	if err != nil {
 		return nil, err
@@ -199,7 +228,7 @@ func connect(client net.Conn) (net.Conn, error) {
 	}
 	destAddr := fmt.Sprintf("%s:%d", addr, port)
 
-	dest, err := TryDial(client, destAddr)
+	dest, err := tryDial(client, destAddr, opts)
 	if err != nil {
 		return nil, err
 	}
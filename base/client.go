@@ -0,0 +1,201 @@
+package base
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ReplyError is returned when a SOCKS5 server answers a CONNECT with a
+// non-zero reply code.
+type ReplyError byte
+
+var replyMessages = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (e ReplyError) Error() string {
+	msg, ok := replyMessages[byte(e)]
+	if !ok {
+		msg = "unassigned"
+	}
+	return fmt.Sprintf("reply code %d: %s", byte(e), msg)
+}
+
+// Dial connects to the SOCKS5 server at proxyAddr and asks it to CONNECT to
+// addr. It returns the tunnel and the address the server bound for it.
+func Dial(proxyAddr, addr string) (net.Conn, string, error) {
+	return DialContext(context.Background(), proxyAddr, addr)
+}
+
+// DialContext is like Dial but the whole exchange, including the handshake,
+// is bounded by ctx.
+func DialContext(ctx context.Context, proxyAddr, addr string) (net.Conn, string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, "", errors.New("invalid port: " + portStr)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	bnd, err := HandshakeContext(ctx, conn, host, uint16(port))
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, bnd, nil
+}
+
+// HandshakeContext runs ClientHandshake on an established connection,
+// aborting it when ctx is done.
+func HandshakeContext(ctx context.Context, conn net.Conn, host string, port uint16) (string, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// unblock any pending read or write
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	bnd, err := ClientHandshake(conn, host, port)
+	close(done)
+	// the goroutine may still be setting the deadline, which must not
+	// outlive the handshake
+	<-exited
+	conn.SetDeadline(time.Time{})
+	if err != nil && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return bnd, err
+}
+
+// ClientHandshake negotiates the no-auth method on conn and sends a CONNECT
+// for host:port. The address type is derived from host.
+func ClientHandshake(conn net.Conn, host string, port uint16) (bnd string, err error) {
+	if err = clientAuth(conn); err != nil {
+		return
+	}
+	req, err := encodeRequest(host, port)
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(req); err != nil {
+		return "", errors.New("failed to write request")
+	}
+	return readReply(conn)
+}
+
+func clientAuth(conn net.Conn) error {
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return errors.New("failed to write methods")
+	}
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return errors.New("failed to read method selection")
+	}
+	if buf[0] != 5 {
+		return errors.New("invalid version")
+	}
+	if buf[1] != 0 {
+		return fmt.Errorf("method %#x not supported", buf[1])
+	}
+	return nil
+}
+
+func encodeRequest(host string, port uint16) ([]byte, error) {
+	buf := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+	switch {
+	// IPv4
+	case ip != nil && ip.To4() != nil:
+		buf = append(buf, 1)
+		buf = append(buf, ip.To4()...)
+	// IPv6
+	case ip != nil:
+		buf = append(buf, 4)
+		buf = append(buf, ip.To16()...)
+	// hostname
+	default:
+		if len(host) == 0 || len(host) > 255 {
+			return nil, errors.New("invalid hostname length")
+		}
+		buf = append(buf, 3, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+func readReply(conn net.Conn) (string, error) {
+	var buf [256]byte
+	// some servers close right after VER and REP on failure
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", errors.New("failed to read reply header")
+	}
+	ver, rep := buf[0], buf[1]
+	if ver != 5 {
+		return "", errors.New("invalid version")
+	}
+	if rep != 0 {
+		return "", ReplyError(rep)
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", errors.New("failed to read reply header")
+	}
+	atyp := buf[1]
+	var host string
+	switch atyp {
+	// IPv4
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return "", errors.New("failed to read IPv4 address")
+		}
+		host = net.IP(buf[:4]).String()
+	// hostname
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", errors.New("failed to read hostname")
+		}
+		addrLen := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:addrLen]); err != nil {
+			return "", errors.New("failed to read hostname")
+		}
+		host = string(buf[:addrLen])
+	// IPv6
+	case 4:
+		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
+			return "", errors.New("failed to read IPv6 address")
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		return "", errors.New("invalid atyp")
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", errors.New("failed to read port")
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
@@ -0,0 +1,179 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeServer scripts the server side of a SOCKS5 CONNECT on conn: it
+// answers the greeting with method, then, if that is no-auth, reads the
+// request and writes reply. The request it read is sent on the returned
+// channel.
+func fakeServer(t *testing.T, conn net.Conn, method byte, reply []byte) <-chan []byte {
+	t.Helper()
+	reqs := make(chan []byte, 1)
+	go func() {
+		defer close(reqs)
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte{5, method}); err != nil || method != 0 {
+			return
+		}
+		req := make([]byte, 4, 262)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		var n int
+		switch req[3] {
+		case 1:
+			n = 4
+		case 4:
+			n = 16
+		case 3:
+			l := make([]byte, 1)
+			if _, err := io.ReadFull(conn, l); err != nil {
+				return
+			}
+			req = append(req, l[0])
+			n = int(l[0])
+		}
+		rest := make([]byte, n+2)
+		if _, err := io.ReadFull(conn, rest); err != nil {
+			return
+		}
+		reqs <- append(req, rest...)
+		conn.Write(reply)
+	}()
+	return reqs
+}
+
+func TestClientHandshakeReplyCodes(t *testing.T) {
+	for rep := byte(1); rep <= 9; rep++ {
+		client, server := net.Pipe()
+		// servers may close after VER and REP on failure
+		fakeServer(t, server, 0, []byte{5, rep})
+		_, err := ClientHandshake(client, "example.com", 80)
+		var replyErr ReplyError
+		if !errors.As(err, &replyErr) || byte(replyErr) != rep {
+			t.Errorf("reply %d: got error %v, want ReplyError(%d)", rep, err, rep)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestClientHandshakeAddressTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		port    uint16
+		request []byte
+		reply   []byte
+		bnd     string
+	}{
+		{
+			name:    "IPv4",
+			host:    "192.0.2.1",
+			port:    80,
+			request: []byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80},
+			reply:   []byte{5, 0, 0, 1, 10, 0, 0, 1, 0x1f, 0x90},
+			bnd:     "10.0.0.1:8080",
+		},
+		{
+			name:    "IPv6",
+			host:    "2001:db8::1",
+			port:    443,
+			request: []byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0xbb},
+			reply:   []byte{5, 0, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 53},
+			bnd:     "[2001:db8::2]:53",
+		},
+		{
+			name:    "domain",
+			host:    "example.com",
+			port:    8443,
+			request: append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0x20, 0xfb),
+			reply:   append(append([]byte{5, 0, 0, 3, 9}, "proxy.lan"...), 0x04, 0x38),
+			bnd:     "proxy.lan:1080",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			reqs := fakeServer(t, server, 0, tt.reply)
+			bnd, err := ClientHandshake(client, tt.host, tt.port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bnd != tt.bnd {
+				t.Errorf("bound address %q, want %q", bnd, tt.bnd)
+			}
+			if req := <-reqs; !bytes.Equal(req, tt.request) {
+				t.Errorf("request %v, want %v", req, tt.request)
+			}
+		})
+	}
+}
+
+func TestClientHandshakeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		method byte
+		reply  []byte
+	}{
+		{"method rejected", 0xff, nil},
+		{"bad version", 0, []byte{4, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"bad atyp", 0, []byte{5, 0, 0, 2, 0, 0, 0, 0, 0, 0}},
+		{"short reply", 0, []byte{5, 0, 0, 1, 10, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			reqs := fakeServer(t, server, tt.method, tt.reply)
+			go func() {
+				<-reqs
+				server.Close()
+			}()
+			if _, err := ClientHandshake(client, "example.com", 80); err == nil {
+				t.Error("handshake succeeded")
+			}
+		})
+	}
+}
+
+func TestHandshakeContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	fakeServer(t, server, 0, []byte{5, 0, 0, 1, 10, 0, 0, 1, 0, 80})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	if _, err := HandshakeContext(ctx, client, "example.com", 80); err != nil {
+		t.Fatal(err)
+	}
+	// cancelling afterwards must not break the tunnel
+	cancel()
+	go server.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := client.Read(buf); err != nil {
+		t.Fatal("tunnel read:", err)
+	}
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	// the server never answers
+	if _, err := HandshakeContext(ctx, client2, "example.com", 80); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,338 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Address family policies for direct dials.
+const (
+	IPv4Only      = "ipv4-only"
+	IPv6Only      = "ipv6-only"
+	PreferIPv4    = "prefer-v4"
+	PreferIPv6    = "prefer-v6"
+	HappyEyeballs = "happy-eyeballs"
+)
+
+// DialOptions control how direct connections are made.
+type DialOptions struct {
+	Family string
+	// Delay between staggered attempts with HappyEyeballs.
+	Delay time.Duration
+	// Source is the local address to connect from, only destinations of
+	// its family are tried.
+	Source net.IP
+	// Interface binds the socket to a network device (SO_BINDTODEVICE).
+	Interface string
+	// Mark sets the fwmark (SO_MARK) for policy routing.
+	Mark int
+}
+
+// DefaultDialOptions is used by DialDirect.
+var DefaultDialOptions = DialOptions{Family: HappyEyeballs, Delay: 250 * time.Millisecond}
+
+var errFamily = errors.New("no address of the allowed family")
+
+// ParseOutbound reads "key value" pairs from name:
+//
+//	family    happy-eyeballs  ipv4-only, ipv6-only, prefer-v4, prefer-v6 or happy-eyeballs
+//	delay     250ms           happy eyeballs connection attempt delay
+//	source    192.168.1.2     local address to connect from
+//	interface eth1            network device to bind to
+//	mark      100             fwmark for policy routing
+//
+// Pairs before the first "[name]" line give the default options. Each
+// "[name]" starts a named profile, which starts as a copy of the default.
+func ParseOutbound(name string) (def *DialOptions, profiles map[string]*DialOptions, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	opts := DefaultDialOptions
+	def = &opts
+	profiles = make(map[string]*DialOptions)
+	cur := def
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		key := scanner.Text()
+		if strings.HasPrefix(key, "[") && strings.HasSuffix(key, "]") && len(key) > 2 {
+			profile := *def
+			cur = &profile
+			profiles[key[1:len(key)-1]] = cur
+			continue
+		}
+		if !scanner.Scan() {
+			return nil, nil, errors.New("missing value for " + key)
+		}
+		if err = cur.set(key, scanner.Text()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return def, profiles, nil
+}
+
+func (o *DialOptions) set(key, value string) error {
+	var err error
+	switch key {
+	case "family":
+		switch value {
+		case IPv4Only, IPv6Only, PreferIPv4, PreferIPv6, HappyEyeballs:
+		default:
+			return errors.New("unknown family " + value)
+		}
+		o.Family = value
+	case "delay":
+		o.Delay, err = time.ParseDuration(value)
+		if err != nil || o.Delay < 0 {
+			return errors.New("invalid delay " + value)
+		}
+	case "source":
+		o.Source = net.ParseIP(value)
+		if o.Source == nil {
+			return errors.New("invalid source address " + value)
+		}
+	case "interface":
+		o.Interface = value
+	case "mark":
+		o.Mark, err = strconv.Atoi(value)
+		if err != nil {
+			return errors.New("invalid mark " + value)
+		}
+	default:
+		return errors.New("unknown key " + key)
+	}
+	return nil
+}
+
+// DialDirect connects to addr over TCP with DefaultDialOptions.
+func DialDirect(ctx context.Context, addr string) (net.Conn, error) {
+	return DefaultDialOptions.Dial(ctx, addr)
+}
+
+// ResolutionDelay is how long happy eyeballs waits for the AAAA answer
+// once the A answer is in (RFC 8305 section 3).
+const ResolutionDelay = 50 * time.Millisecond
+
+// Dial connects to addr over TCP, resolving a hostname with
+// DefaultResolver and trying its addresses as the family policy says.
+// Happy eyeballs asks for both families at once and starts connecting as
+// soon as the AAAA answer, or the A answer and ResolutionDelay, is in;
+// addresses answered later join the attempts not started yet.
+func (o *DialOptions) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return o.dialIPs(ctx, []net.IP{ip}, port, nil)
+	}
+	resolver, network := DefaultResolver, o.network()
+	if o.Family != HappyEyeballs || network != "ip" {
+		ips, err := resolver.LookupIP(ctx, network, host)
+		if err != nil {
+			return nil, err
+		}
+		return o.dialIPs(ctx, ips, port, nil)
+	}
+
+	type answer struct {
+		ips []net.IP
+		err error
+		v6  bool
+	}
+	// a lookup still running is of no use once connected
+	lookupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	answers := make(chan answer, 2)
+	for _, network := range []string{"ip6", "ip4"} {
+		go func(network string) {
+			ips, err := resolver.LookupIP(lookupCtx, network, host)
+			answers <- answer{ips, err, network == "ip6"}
+		}(network)
+	}
+	first := <-answers
+	if len(first.ips) == 0 || !first.v6 {
+		// wait for the other answer, but only for ResolutionDelay if
+		// the first one has addresses
+		var wait <-chan time.Time
+		if len(first.ips) > 0 {
+			timer := time.NewTimer(ResolutionDelay)
+			defer timer.Stop()
+			wait = timer.C
+		}
+		select {
+		case second := <-answers:
+			ips := append(first.ips, second.ips...)
+			if len(ips) == 0 {
+				if first.err != nil {
+					return nil, first.err
+				}
+				return nil, second.err
+			}
+			return o.dialIPs(ctx, ips, port, nil)
+		case <-wait:
+		}
+	}
+	late := make(chan []net.IP, 1)
+	go func() {
+		late <- (<-answers).ips
+	}()
+	return o.dialIPs(ctx, first.ips, port, late)
+}
+
+// network is the address family to resolve for the policy and source
+// address.
+func (o *DialOptions) network() string {
+	switch {
+	case o.Family == IPv4Only || o.Source != nil && o.Source.To4() != nil:
+		return "ip4"
+	case o.Family == IPv6Only || o.Source != nil:
+		return "ip6"
+	}
+	return "ip"
+}
+
+// dialIPs connects to port on one of ips, or of those arriving on late.
+func (o *DialOptions) dialIPs(ctx context.Context, ips []net.IP, port string, late <-chan []net.IP) (net.Conn, error) {
+	ips = o.sort(ips)
+	if len(ips) == 0 && late == nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errFamily}
+	}
+	delay := time.Duration(0)
+	if o.Family == HappyEyeballs {
+		delay = o.Delay
+	}
+	return o.dialStaggered(ctx, ips, port, late, delay)
+}
+
+// sort filters and orders ips by family. Happy eyeballs interleaves the
+// families starting with IPv6 (RFC 8305 section 4).
+func (o *DialOptions) sort(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if o.Source != nil && (o.Source.To4() != nil) != (ip.To4() != nil) {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch o.Family {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case PreferIPv4:
+		return append(v4, v6...)
+	case PreferIPv6:
+		return append(v6, v4...)
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialStaggered tries port on ips in order, starting the next attempt when
+// the previous one fails or, if delay is not zero, after delay. Addresses
+// arriving on late are sorted in with those not tried yet. The first
+// connection to succeed is returned and the others are closed.
+func (o *DialOptions) dialStaggered(ctx context.Context, ips []net.IP, port string, late <-chan []net.IP, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d := net.Dialer{Control: o.control}
+	if o.Source != nil {
+		d.LocalAddr = &net.TCPAddr{IP: o.Source}
+	}
+	results := make(chan dialResult)
+	queue, pending := ips, 0
+	start := func() {
+		addr := net.JoinHostPort(queue[0].String(), port)
+		queue = queue[1:]
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	var lastErr error
+	if len(queue) > 0 {
+		start()
+	}
+	done := ctx.Done()
+	for pending > 0 || late != nil {
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if delay > 0 && pending > 0 && len(queue) > 0 {
+			timer = time.NewTimer(delay)
+			timeout = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				// close the losers as they come in
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if len(queue) > 0 {
+				start()
+			}
+		case more := <-late:
+			late = nil
+			queue = o.sort(append(queue, more...))
+			if pending == 0 && len(queue) > 0 {
+				start()
+			}
+		case <-timeout:
+			start()
+		case <-done:
+			if pending == 0 {
+				// only waiting for late addresses
+				return nil, ctx.Err()
+			}
+			// the attempts fail with it, start no more
+			done, late, queue = nil, nil, nil
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	if lastErr == nil {
+		lastErr = &net.OpError{Op: "dial", Net: "tcp", Err: errFamily}
+	}
+	return nil, lastErr
+}
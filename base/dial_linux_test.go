@@ -0,0 +1,166 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// hangingListener listens on ip without ever accepting and fills its
+// accept queue, so further connection attempts hang. It returns the port.
+func hangingListener(t *testing.T, ip net.IP, port int) int {
+	t.Helper()
+	family := syscall.AF_INET6
+	var sa syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		family = syscall.AF_INET
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err = syscall.Bind(fd, sa); err != nil {
+		t.Skip(err)
+	}
+	if err = syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	bound, _ := syscall.Getsockname(fd)
+	switch bound := bound.(type) {
+	case *syscall.SockaddrInet4:
+		port = bound.Port
+	case *syscall.SockaddrInet6:
+		port = bound.Port
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	for i := 0; i < 4; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return port
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	t.Skip("accept queue does not fill up")
+	return 0
+}
+
+// listenerAt listens on ip:port and accepts connections.
+func listenerAt(t *testing.T, ip net.IP, port int) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return l
+}
+
+var (
+	loopback4  = net.IPv4(127, 0, 0, 1)
+	loopback4b = net.IPv4(127, 0, 0, 2)
+	loopback6  = net.IPv6loopback
+)
+
+func TestDialStaggered(t *testing.T) {
+	port := hangingListener(t, loopback4, 0)
+	listenerAt(t, loopback4b, port)
+	p := strconv.Itoa(port)
+
+	// the next attempt starts after the delay
+	o := &DialOptions{Family: HappyEyeballs}
+	start := time.Now()
+	conn, err := o.dialStaggered(context.Background(), []net.IP{loopback4, loopback4b}, p, nil, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(loopback4b) {
+		t.Errorf("connected to %s", got)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("connected after %v", d)
+	}
+
+	// without a delay it waits for the first attempt to fail
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if conn, err = o.dialStaggered(ctx, []net.IP{loopback4, loopback4b}, p, nil, 0); err == nil {
+		conn.Close()
+		t.Error("connected without waiting")
+	}
+	if d := time.Since(start); d < 300*time.Millisecond || d > time.Second {
+		t.Errorf("failed after %v", d)
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	port := hangingListener(t, loopback6, 0)
+	listenerAt(t, loopback4, port)
+	addr := net.JoinHostPort("dual.test", strconv.Itoa(port))
+	o := &DialOptions{Family: HappyEyeballs, Delay: 100 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		v4, v6   fakeAnswer
+		min, max time.Duration
+	}{
+		// A first: the AAAA answer is not waited for beyond the
+		// resolution delay
+		{"slow AAAA", fakeAnswer{ips: ips("127.0.0.1")}, fakeAnswer{ips: ips("::1"), delay: 5 * time.Second}, ResolutionDelay, time.Second},
+		// AAAA first: connecting starts at once, the A answer joins
+		// and is tried after the connection attempt delay
+		{"slow A", fakeAnswer{ips: ips("127.0.0.1"), delay: 50 * time.Millisecond}, fakeAnswer{ips: ips("::1")}, 100 * time.Millisecond, time.Second},
+		// both in time: IPv6 is tried first, IPv4 after the delay
+		{"both", fakeAnswer{ips: ips("127.0.0.1")}, fakeAnswer{ips: ips("::1"), delay: 10 * time.Millisecond}, 100 * time.Millisecond, time.Second},
+		// no AAAA at all
+		{"no AAAA", fakeAnswer{ips: ips("127.0.0.1"), delay: 20 * time.Millisecond}, fakeAnswer{err: errors.New("no AAAA")}, 20 * time.Millisecond, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useResolver(t, &fakeDNS{answers: map[string]fakeAnswer{"ip4": tt.v4, "ip6": tt.v6}})
+			start := time.Now()
+			conn, err := o.Dial(context.Background(), addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if got := conn.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(loopback4) {
+				t.Errorf("connected to %s", got)
+			}
+			if d := time.Since(start); d < tt.min || d > tt.max {
+				t.Errorf("connected after %v, want %v to %v", d, tt.min, tt.max)
+			}
+		})
+	}
+
+	// only the hanging address: the context ends it
+	useResolver(t, &fakeDNS{answers: map[string]fakeAnswer{"ip4": {err: errors.New("no A")}, "ip6": {ips: ips("::1")}}})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if conn, err := o.Dial(ctx, addr); err == nil {
+		conn.Close()
+		t.Error("connected to the hanging listener")
+	}
+}
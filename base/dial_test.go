@@ -0,0 +1,153 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeAnswer struct {
+	ips   []net.IP
+	err   error
+	delay time.Duration
+}
+
+// fakeDNS answers "ip4" and "ip6" lookups after their delay, and "ip" with
+// both.
+type fakeDNS struct {
+	answers map[string]fakeAnswer
+	mu      sync.Mutex
+	asked   []string
+}
+
+func (f *fakeDNS) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	f.mu.Lock()
+	f.asked = append(f.asked, network)
+	f.mu.Unlock()
+	if network == "ip" {
+		v4, err4 := f.LookupIP(ctx, "ip4", host)
+		v6, err6 := f.LookupIP(ctx, "ip6", host)
+		if len(v4)+len(v6) == 0 {
+			if err4 != nil {
+				return nil, err4
+			}
+			return nil, err6
+		}
+		return append(v4, v6...), nil
+	}
+	a := f.answers[network]
+	select {
+	case <-time.After(a.delay):
+		return a.ips, a.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *fakeDNS) networks() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.asked...)
+}
+
+// useResolver makes r the DefaultResolver for the test.
+func useResolver(t *testing.T, r Resolver) {
+	old := DefaultResolver
+	DefaultResolver = r
+	t.Cleanup(func() { DefaultResolver = old })
+}
+
+func ips(s ...string) []net.IP {
+	var ips []net.IP
+	for _, ip := range s {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips
+}
+
+func TestDialSort(t *testing.T) {
+	in := ips("192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3", "2001:db8::2")
+	tests := []struct {
+		family string
+		source string
+		want   []net.IP
+	}{
+		{IPv4Only, "", ips("192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{IPv6Only, "", ips("2001:db8::1", "2001:db8::2")},
+		{PreferIPv4, "", ips("192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2")},
+		{PreferIPv6, "", ips("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{HappyEyeballs, "", ips("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3")},
+		// a source address allows only its own family
+		{HappyEyeballs, "10.0.0.1", ips("192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{PreferIPv4, "fd00::1", ips("2001:db8::1", "2001:db8::2")},
+		{IPv6Only, "10.0.0.1", nil},
+	}
+	for _, tt := range tests {
+		o := &DialOptions{Family: tt.family, Source: net.ParseIP(tt.source)}
+		got := o.sort(in)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s: got %v, want %v", tt.family, tt.source, got, tt.want)
+		}
+	}
+	o := &DialOptions{Family: HappyEyeballs}
+	if got := o.sort(ips("2001:db8::1", "2001:db8::2")); !reflect.DeepEqual(got, ips("2001:db8::1", "2001:db8::2")) {
+		t.Errorf("one family: got %v", got)
+	}
+}
+
+func TestDialFamily(t *testing.T) {
+	l := listenerAt(t, loopback4, 0)
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	tests := []struct {
+		family string
+		source string
+		asked  []string
+		ok     bool
+	}{
+		{IPv4Only, "", []string{"ip4"}, true},
+		{IPv6Only, "", []string{"ip6"}, false},
+		{PreferIPv4, "", []string{"ip", "ip4", "ip6"}, true},
+		{HappyEyeballs, "127.0.0.1", []string{"ip4"}, true},
+	}
+	for _, tt := range tests {
+		dns := &fakeDNS{answers: map[string]fakeAnswer{"ip4": {ips: ips("127.0.0.1")}, "ip6": {err: errors.New("no AAAA")}}}
+		useResolver(t, dns)
+		o := &DialOptions{Family: tt.family, Source: net.ParseIP(tt.source)}
+		conn, err := o.Dial(context.Background(), net.JoinHostPort("host.test", port))
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.family, err)
+		}
+		if got := dns.networks(); !reflect.DeepEqual(got, tt.asked) {
+			t.Errorf("%s: asked for %v, want %v", tt.family, got, tt.asked)
+		}
+	}
+
+	// an address of the wrong family is not tried
+	o := &DialOptions{Family: IPv6Only}
+	if _, err := o.Dial(context.Background(), net.JoinHostPort("127.0.0.1", port)); !errors.Is(err, errFamily) {
+		t.Errorf("wrong family literal: got %v", err)
+	}
+}
+
+func TestDialLookupErrors(t *testing.T) {
+	errA, errAAAA := errors.New("no A"), errors.New("no AAAA")
+	useResolver(t, &fakeDNS{answers: map[string]fakeAnswer{
+		"ip4": {err: errA},
+		"ip6": {err: errAAAA, delay: 50 * time.Millisecond},
+	}})
+	o := &DialOptions{Family: HappyEyeballs, Delay: 250 * time.Millisecond}
+	if _, err := o.Dial(context.Background(), "host.test:80"); err != errA {
+		t.Errorf("got %v, want the first error", err)
+	}
+}
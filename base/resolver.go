@@ -0,0 +1,152 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"proxy/dns"
+	"strings"
+)
+
+// Resolver looks up the addresses of a host for direct dials. As with
+// net.Resolver, network is "ip" for both families, "ip4" or "ip6".
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// DefaultResolver is used by every direct dial.
+var DefaultResolver Resolver = SystemResolver{}
+
+// SystemResolver asks the operating system.
+type SystemResolver struct{}
+
+func (SystemResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, network, host)
+}
+
+// DNSResolver sends A and AAAA queries to Upstream, typically a
+// dns.Parallel of several backends, and caches the answers.
+type DNSResolver struct {
+	Upstream dns.Upstream
+	// Cache may be nil to disable caching.
+	Cache *dns.Cache
+}
+
+func (r *DNSResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var qtypes []uint16
+	switch network {
+	case "ip":
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	case "ip4":
+		qtypes = []uint16{dns.TypeA}
+	case "ip6":
+		qtypes = []uint16{dns.TypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	results := make(chan result, len(qtypes))
+	for _, qtype := range qtypes {
+		go func(qtype uint16) {
+			ips, err := r.lookup(ctx, host, qtype)
+			results <- result{ips, err}
+		}(qtype)
+	}
+	var ips []net.IP
+	var firstErr error
+	for range qtypes {
+		res := <-results
+		ips = append(ips, res.ips...)
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no such host")
+	}
+	return nil, &net.DNSError{Err: firstErr.Error(), Name: host, IsNotFound: firstErr.Error() == "no such host"}
+}
+
+func (r *DNSResolver) lookup(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	q := dns.Question{Name: strings.TrimSuffix(host, ".") + ".", Type: qtype, Class: dns.ClassINET}
+	var idBuf [2]byte
+	rand.Read(idBuf[:])
+	id := uint16(idBuf[0])<<8 | uint16(idBuf[1])
+	var resp []byte
+	cached := false
+	if r.Cache != nil {
+		resp = r.Cache.Get(q, id)
+		cached = resp != nil
+	}
+	if !cached {
+		query, err := dns.NewQuery(id, q.Name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = r.Upstream.Exchange(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m, err := dns.Parse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if r.Cache != nil && !cached {
+		r.Cache.Put(q, resp, m)
+	}
+	if m.Rcode() == dns.RcodeNameError {
+		return nil, errors.New("no such host")
+	}
+	var ips []net.IP
+	for _, ip := range m.IPs() {
+		if (qtype == dns.TypeA) == (ip.To4() != nil) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// ParseResolver reads a resolver file: "ON" or "OFF" followed by upstreams
+// in the form accepted by dns.ParseUpstream, all queried in parallel. OFF
+// selects the system resolver.
+func ParseResolver(name string) (Resolver, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+
+	scanner.Scan()
+	state := scanner.Text()
+	if state == "OFF" {
+		return SystemResolver{}, nil
+	} else if state != "ON" {
+		return nil, errors.New("first word should be \"ON\" or \"OFF\"")
+	}
+
+	var upstreams dns.Parallel
+	for scanner.Scan() {
+		upstream, err := dns.ParseUpstream(scanner.Text(), nil)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream found")
+	}
+	return &DNSResolver{Upstream: upstreams, Cache: dns.NewCache(4096)}, nil
+}
@@ -0,0 +1,132 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"proxy/dns"
+)
+
+// countingUpstream answers A queries with 192.0.2.1 and counts queries.
+type countingUpstream struct {
+	queries int32
+}
+
+func (u *countingUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	atomic.AddInt32(&u.queries, 1)
+	m, err := dns.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	q, _ := m.Question()
+	var answers []dns.RR
+	if q.Type == dns.TypeA {
+		answers = append(answers, dns.RR{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET, TTL: 60, Data: []byte{192, 0, 2, 1}})
+	}
+	return dns.AnswerReply(m, dns.RcodeSuccess, answers)
+}
+
+func TestDNSResolverCache(t *testing.T) {
+	up := &countingUpstream{}
+	r := &DNSResolver{Upstream: up, Cache: dns.NewCache(16)}
+	for _, host := range []string{"example.com", "example.com."} {
+		ips, err := r.LookupIP(context.Background(), "ip", host)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Errorf("%s: got %v", host, ips)
+		}
+	}
+	// one A and one AAAA query, the second lookup is answered by the cache
+	if n := atomic.LoadInt32(&up.queries); n != 2 {
+		t.Errorf("%d upstream queries, want 2", n)
+	}
+}
+
+// standInDNS answers A and AAAA queries for example.com over UDP and
+// NXDOMAIN for anything else.
+func standInDNS(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := dns.Parse(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, _ := m.Question()
+			var resp []byte
+			switch {
+			case dns.CanonicalName(q.Name) != "example.com":
+				resp, _ = dns.Reply(m, dns.RcodeNameError)
+			case q.Type == dns.TypeA:
+				resp, _ = dns.AnswerReply(m, dns.RcodeSuccess, []dns.RR{{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET, TTL: 60, Data: []byte{192, 0, 2, 1}}})
+			case q.Type == dns.TypeAAAA:
+				resp, _ = dns.AnswerReply(m, dns.RcodeSuccess, []dns.RR{{Name: q.Name, Type: dns.TypeAAAA, Class: dns.ClassINET, TTL: 60, Data: net.ParseIP("2001:db8::1")}})
+			default:
+				resp, _ = dns.Reply(m, dns.RcodeSuccess)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestParseResolver(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "resolver.db")
+	// the first upstream is down, the stand-in answers
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	data := "ON\ntcp://" + dead.Addr().String() + "\n" + standInDNS(t) + "\n"
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ParseResolver(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ips, err := r.LookupIP(ctx, "ip", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"192.0.2.1": true, "2001:db8::1": true}
+	if len(ips) != 2 || !want[ips[0].String()] || !want[ips[1].String()] {
+		t.Errorf("got %v", ips)
+	}
+	_, err = r.LookupIP(ctx, "ip", "missing.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("missing name: got %v", err)
+	}
+
+	if err := os.WriteFile(name, []byte("OFF\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = ParseResolver(name); err != nil || r != (SystemResolver{}) {
+		t.Errorf("OFF: got %v, %v", r, err)
+	}
+	if err := os.WriteFile(name, []byte("ON\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseResolver(name); err == nil {
+		t.Error("no upstream accepted")
+	}
+}
@@ -0,0 +1,24 @@
+package base
+
+import "syscall"
+
+// control applies the interface binding and fwmark to a socket before it
+// connects.
+func (o *DialOptions) control(network, address string, c syscall.RawConn) error {
+	if o.Interface == "" && o.Mark == 0 {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if o.Interface != "" {
+			err = syscall.BindToDevice(int(fd), o.Interface)
+		}
+		if err == nil && o.Mark != 0 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package base
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (o *DialOptions) control(network, address string, c syscall.RawConn) error {
+	if o.Interface != "" || o.Mark != 0 {
+		return errors.New("interface binding and fwmark are only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"proxy/reverse"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const usage = `Usage: proxy <command> [flags] [args]
+
+Commands:
+  client        run the proxy client with its SOCKS5 servers, reverse and DNS servers (default)
+  server        run SOCKS5 servers only, on the given addresses or those in the proxy address file
+  reverse       run the reverse proxy only
+  check-config  parse every config file and report errors
+  test-rule     show how a connection to host port would be routed
+  pac           write a PAC file for the current rules
+  ca            create a local CA for the reverse proxy to issue certificates with
+  version       print the version
+
+Run "proxy <command> -h" for the flags of a command. Every flag can also
+be set with an environment variable named after it, e.g. -socks-rules by
+PROXY_SOCKS_RULES; the flag wins.
+`
+
+// config holds the listen addresses and file names the commands share.
+type config struct {
+	listen        string
+	reverseListen string
+	reverseTLS    string
+	hostsAddrs    string
+	lastHop       string
+
+	proxyAddr    string
+	socksRules   string
+	programRules string
+	httpRules    string
+	reverseList  string
+	resolver     string
+	outbound     string
+	dns          string
+	hosts        string
+}
+
+// files registers the file name flags on fs.
+func (c *config) files(fs *flag.FlagSet) {
+	envString(fs, &c.proxyAddr, "proxy-addr", "proxyAddr.db", "file listing the proxy chain addresses")
+	envString(fs, &c.socksRules, "socks-rules", "socksRule.db", "hostname and CIDR rule file")
+	envString(fs, &c.programRules, "program-rules", "programRule.db", "program rule file")
+	envString(fs, &c.httpRules, "http-rules", "httpRule.db", "HTTP rule file")
+	envString(fs, &c.reverseList, "reverse-list", "reverseList.db", "reverse proxy host list")
+	envString(fs, &c.resolver, "resolver", "resolver.db", "resolver for direct connections, optional")
+	envString(fs, &c.outbound, "outbound", "outbound.db", "outbound dial options and profiles, optional")
+	envString(fs, &c.dns, "dns", "dns.db", "DNS server config, optional")
+	envString(fs, &c.hosts, "hosts-file", reverse.DefaultHostsFile, "hosts file reverse proxy names are added to")
+}
+
+// addrs registers the listen address flags on fs.
+func (c *config) addrs(fs *flag.FlagSet) {
+	envString(fs, &c.listen, "listen", "0.0.0.0:8080", "address the client (SOCKS5/HTTP) listens on")
+	envString(fs, &c.reverseListen, "reverse-listen", "127.0.0.1:80", "address the reverse proxy listens on")
+	envString(fs, &c.reverseTLS, "reverse-tls-listen", "127.0.0.1:443", "address the reverse proxy accepts TLS on, if the reverse list has cert or passthrough entries")
+	envString(fs, &c.hostsAddrs, "hosts-addrs", "127.0.0.1", "comma-separated addresses reverse proxy names point to, e.g. 127.0.0.1,::1")
+	envString(fs, &c.lastHop, "last-hop", "127.0.0.1:7891", "last hop appended to the proxy chain")
+}
+
+// envString defines a string flag whose default is taken from the
+// environment variable PROXY_<NAME> if it is set.
+func envString(fs *flag.FlagSet, p *string, name, value, help string) {
+	env := "PROXY_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	if v, ok := os.LookupEnv(env); ok {
+		value = v
+	}
+	fs.StringVar(p, name, value, help+" ($"+env+")")
+}
+
+// newFlagSet returns a flag set for command that reports usage errors
+// instead of exiting.
+func newFlagSet(command, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: proxy %s [flags] %s\n", command, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args into fs and returns the exit code to use if the
+// command should not go on.
+func parseFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return exitOK, false
+	}
+	if err != nil {
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// reverseServer sets up rs with the hosts file options of c.
+func (c *config) reverseServer(rs *reverse.ReverseServer) {
+	rs.HostsFile = c.hosts
+	rs.HostsAddrs = strings.Split(c.hostsAddrs, ",")
+}
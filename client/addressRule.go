@@ -16,7 +16,54 @@ type Rules struct {
 	keyword map[string]bool
 	cidr    map[*net.IPNet]bool
 	program map[string]bool
-	http    map[string]bool
+	// program conditions in the order of the rule file
+	procConds []procCond
+	http      map[string]bool
+	// outbound profile names by rule group and key, for rules written
+	// as rule@profile
+	outbound map[string]string
+}
+
+// Rule groups, in the order they are evaluated.
+const (
+	ruleProgram  = "ProgramRule"
+	ruleHostname = "HostnameKeyword"
+	ruleCIDR     = "CIDR"
+	ruleHttp     = "HttpKeyword"
+)
+
+// splitOutbound splits a rule word of the form rule@profile.
+func splitOutbound(word string) (string, string) {
+	i := strings.LastIndexByte(word, '@')
+	if i <= 0 {
+		return word, ""
+	}
+	return word[:i], word[i+1:]
+}
+
+func (r *Rules) setOutbound(rule, key, profile string) {
+	if profile == "" {
+		return
+	}
+	if r.outbound == nil {
+		r.outbound = make(map[string]string)
+	}
+	r.outbound[rule+" "+key] = profile
+}
+
+// Outbound returns the outbound profile of the rule matched as key in the
+// given group, or "" for the default.
+func (r *Rules) Outbound(rule, key string) string {
+	return r.outbound[rule+" "+key]
+}
+
+// Profiles returns all outbound profile names used by the rules.
+func (r *Rules) Profiles() []string {
+	var names []string
+	for _, name := range r.outbound {
+		names = append(names, name)
+	}
+	return names
 }
 
 func (r *Rules) ParseRules(name string) error {
@@ -42,15 +89,17 @@ func (r *Rules) ParseRules(name string) error {
 	}
 
 	for scanner.Scan() {
-		word := scanner.Text()
+		word, profile := splitOutbound(scanner.Text())
 		_, ipNet, err := net.ParseCIDR(word)
 		// CIDR
 		if err == nil {
 			r.cidr[ipNet] = true
+			r.setOutbound(ruleCIDR, ipNet.String(), profile)
 			continue
 		}
 		// KEYWORD
 		r.keyword[word] = true
+		r.setOutbound(ruleHostname, word, profile)
 	}
 
 	return nil
@@ -2,22 +2,56 @@ package client
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"proxy/base"
+	"proxy/dns"
 	"proxy/reverse"
-	"strconv"
+	"sync"
 )
 
+// RuleFiles names the files ParseRules reads, empty names mean the
+// defaults socksRule.db, programRule.db and httpRule.db.
+type RuleFiles struct {
+	Socks   string
+	Program string
+	Http    string
+}
+
+func (f RuleFiles) names() (socks, program, http string) {
+	socks, program, http = f.Socks, f.Program, f.Http
+	if socks == "" {
+		socks = "socksRule.db"
+	}
+	if program == "" {
+		program = "programRule.db"
+	}
+	if http == "" {
+		http = "httpRule.db"
+	}
+	return
+}
+
 type Client struct {
 	ProxyAddr []string
-	rule      Rules
+	RuleFiles RuleFiles
+	mu        sync.RWMutex
+	rule      *Rules
 	Res       reverse.ReverseServer
-	End       bool
+	// Resolver finds the process behind a connection for program rules.
+	// DefaultResolver is used when nil.
+	Resolver ProcessResolver
+	// Outbound is used for DIRECT connections, base.DefaultDialOptions
+	// when nil. Outbounds holds the profiles rules refer to by name.
+	Outbound  *base.DialOptions
+	Outbounds map[string]*base.DialOptions
+	// FakeIP maps fake-ip addresses handed out by the DNS server back to
+	// hostnames, may be nil.
+	FakeIP *dns.FakeIP
+	End    bool
 }
 
 func (c *Client) ParseProxyAddr(name string) error {
@@ -42,22 +76,50 @@ func (c *Client) ParseProxyAddr(name string) error {
 	return nil
 }
 
+// ParseRules loads all rule files. It may be called again while the client
+// is running; the new rules replace the old ones only if all files parse.
 func (c *Client) ParseRules() (err error) {
-	err = c.rule.ParseRules("socksRule.db")
+	socks, program, http := c.RuleFiles.names()
+	rule := &Rules{}
+	err = rule.ParseRules(socks)
 	if err != nil {
-		return
+		return fmt.Errorf("%s: %w", socks, err)
 	}
-	err = c.rule.ParseProgramRules("programRule.db")
+	err = rule.ParseProgramRules(program)
 	if err != nil {
-		return
+		return fmt.Errorf("%s: %w", program, err)
 	}
-	err = c.rule.ParseHttpRules("httpRule.db")
+	err = rule.ParseHttpRules(http)
 	if err != nil {
-		return
+		return fmt.Errorf("%s: %w", http, err)
 	}
+	for _, profile := range rule.Profiles() {
+		if _, ok := c.Outbounds[profile]; !ok {
+			return errors.New("unknown outbound profile " + profile)
+		}
+	}
+	c.mu.Lock()
+	c.rule = rule
+	c.mu.Unlock()
 	return
 }
 
+func (c *Client) resolver() ProcessResolver {
+	if c.Resolver == nil {
+		return DefaultResolver
+	}
+	return c.Resolver
+}
+
+func (c *Client) rules() *Rules {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.rule == nil {
+		return &Rules{}
+	}
+	return c.rule
+}
+
 func (c *Client) Listen(port net.Listener) {
 	for {
 		receiver, err := port.Accept()
@@ -68,7 +130,23 @@ func (c *Client) Listen(port net.Listener) {
 			fmt.Println("Failed to accept user request:", err)
 			continue
 		}
-		go c.handleRequest(receiver)
+		go c.serveConn(receiver)
+	}
+}
+
+// serveConn sniffs the first byte to tell SOCKS5 from HTTP proxy requests,
+// so both can share one port.
+func (c *Client) serveConn(receiver net.Conn) {
+	conn := newBufConn(receiver)
+	b, err := conn.r.Peek(1)
+	if err != nil {
+		receiver.Close()
+		return
+	}
+	if b[0] == 5 {
+		c.handleRequest(conn)
+	} else {
+		c.handleHTTP(conn)
 	}
 }
 
@@ -85,192 +163,125 @@ func (c *Client) handleRequest(receiver net.Conn) {
 		receiver.Close()
 		return
 	}
+	c.dispatch(&request{conn: receiver, fe: socksFrontend{}, atyp: atyp, addr: addr, port: port})
+}
+
+// dispatch runs the rules against req and connects it directly or through
+// the proxy chain.
+func (c *Client) dispatch(req *request) {
+	// restore the hostname behind a fake-ip address
+	if c.FakeIP != nil && req.atyp != 3 && c.FakeIP.Contains(net.ParseIP(req.addr)) {
+		name, ok := c.FakeIP.Name(net.ParseIP(req.addr))
+		if !ok {
+			fmt.Println("Connection failed: unknown fake-ip address", req.addr)
+			req.fail(base.ReplyError(4))
+			return
+		}
+		req.atyp, req.addr = 3, name
+	}
+	rule := c.rules()
 	// check programRule
-	info := ""
-	isMatch, name, err := c.rule.MatchCmd(receiver)
-	info = "match ProgramKeyword: " + name
+	isMatch, name, err := rule.MatchCmd(req.conn, c.resolver())
 	if err != nil {
 		fmt.Println("Failed to get program info:", err)
-		receiver.Close()
+		req.conn.Close()
 		return
 	}
 	if isMatch {
-		c.directConnect(receiver, atyp, addr, port, []byte{}, info, true)
+		c.directConnect(req, rule, ruleProgram, name)
 		return
 	}
 	// check addressRule
-	if atyp == 3 {
-		isMatch, name = c.rule.MatchKeyword(addr)
-		if isMatch {
-			info = "match HostnameKeyword: " + name
-		}
+	group := ruleHostname
+	if req.atyp == 3 {
+		isMatch, name = rule.MatchKeyword(req.addr)
 	} else {
-		isMatch, name = c.rule.MatchCIDR(net.ParseIP(addr))
-		if isMatch {
-			info = "match CIDR: " + name
-		}
+		group = ruleCIDR
+		isMatch, name = rule.MatchCIDR(net.ParseIP(req.addr))
 	}
 	if isMatch {
-		c.directConnect(receiver, atyp, addr, port, []byte{}, info, true)
+		c.directConnect(req, rule, group, name)
 		return
 	}
 	// check httpRule
-	base.WriteResponse(receiver, net.ParseIP("1.2.3.4"), 8080)
-	isMatch, name, tosend := c.rule.MatchHttp(receiver)
-	info = "match HttpKeyword: " + name
+	if rule.HttpEnabled() && len(req.tosend) == 0 {
+		// the application only sends data once it believes it is connected
+		if err := req.ready(nil); err != nil {
+			req.conn.Close()
+			return
+		}
+		var buf [1024]byte
+		n, _ := req.conn.Read(buf[:])
+		req.tosend = append(req.tosend, buf[:n]...)
+	}
+	isMatch, name = rule.MatchHttp(req.tosend)
 	if isMatch {
-		c.directConnect(receiver, atyp, addr, port, tosend, info, false)
+		c.directConnect(req, rule, ruleHttp, name)
 		return
 	}
 	// proxy
-	c.proxyConnect(receiver, atyp, addr, port, tosend)
+	c.proxyConnect(req)
 }
 
-func (c *Client) directConnect(receiver net.Conn, atyp int, addr string, port uint16, tosend []byte, info string, needRe bool) {
-	if atyp == 4 {
-		addr = "[" + addr + "]"
+// directConnect connects req to its destination through the outbound
+// profile of the rule that matched it.
+func (c *Client) directConnect(req *request, rule *Rules, group, key string) {
+	info := "match " + group + ": " + key
+	opts := c.Outbound
+	if profile := rule.Outbound(group, key); profile != "" {
+		opts = c.Outbounds[profile]
+		info += " @" + profile
 	}
-	destAddr := fmt.Sprintf("%s:%d", addr, port)
-	dest, err := base.TryDial(receiver, destAddr)
+	if opts == nil {
+		opts = &base.DefaultDialOptions
+	}
+
+	destAddr := req.destAddr()
+	dest, err := opts.Dial(context.Background(), destAddr)
 	if err != nil {
 		fmt.Println("Connection failed:", err)
-		receiver.Close()
+		req.fail(err)
 		return
 	}
-
-	if needRe {
-		localAddr := dest.LocalAddr()
-		ip := localAddr.(*net.TCPAddr).IP
-		port = uint16(localAddr.(*net.TCPAddr).Port)
-		err = base.WriteResponse(receiver, ip, port)
-		if err != nil {
-			receiver.Close()
-			dest.Close()
-			fmt.Println("Error:", err)
-			return
-		}
+	if err = req.ready(dest.LocalAddr()); err != nil {
+		req.conn.Close()
+		dest.Close()
+		fmt.Println("Error:", err)
+		return
 	}
 
 	fmt.Println("[DIRECT]:", destAddr, "   ", info)
-	dest.Write(tosend)
-	base.Forward(receiver, dest)
+	dest.Write(req.tosend)
+	base.Forward(req.conn, dest)
 }
 
-func (c *Client) proxyConnect(receiver net.Conn, atyp int, addr string, port uint16, tosend []byte) {
-	sender, err := base.TryDial(receiver, c.ProxyAddr[0])
+// Dialer returns a Dialer going through the client's proxy chain.
+func (c *Client) Dialer() (*Dialer, error) {
+	return NewDialer(c.ProxyAddr)
+}
+
+func (c *Client) proxyConnect(req *request) {
+	destAddr := req.destAddr()
+	d, err := c.Dialer()
 	if err != nil {
 		fmt.Println("Connection failed:", err)
-		receiver.Write([]byte{5, 1})
-		receiver.Close()
+		req.fail(err)
 		return
 	}
-
-	for i := 1; i < len(c.ProxyAddr); i++ {
-		err = clientAuth(sender)
-		if err != nil {
-			fmt.Println("Authentication failed:", err)
-			receiver.Write([]byte{5, 1})
-			receiver.Close()
-			sender.Close()
-			return
-		}
-		pAddr, pPortStr, _ := net.SplitHostPort(c.ProxyAddr[i])
-		pPort, _ := strconv.Atoi(pPortStr)
-		_, _, err = clientConnect(sender, atyp, pAddr, uint16(pPort))
-		if err != nil {
-			fmt.Println("Connection failed:", err)
-			receiver.Write([]byte{5, 1})
-			receiver.Close()
-			sender.Close()
-			return
-		}
-	}
-
-	err = clientAuth(sender)
+	sender, err := d.Dial("tcp", destAddr)
 	if err != nil {
-		fmt.Println("Authentication failed:", err)
-		receiver.Write([]byte{5, 1})
-		receiver.Close()
-		sender.Close()
+		fmt.Println("Connection failed:", err)
+		req.fail(err)
 		return
 	}
-	_, _, err = clientConnect(sender, atyp, addr, port)
-	if err != nil {
-		fmt.Println("Connection failed:", err)
-		receiver.Write([]byte{5, 1})
-		receiver.Close()
+	if err = req.ready(sender.LocalAddr()); err != nil {
+		req.conn.Close()
 		sender.Close()
+		fmt.Println("Error:", err)
 		return
 	}
 
-	if atyp == 4 {
-		addr = "[" + addr + "]"
-	}
-	destAddr := fmt.Sprintf("%s:%d", addr, port)
 	fmt.Println("[PROXY]:", destAddr)
-	sender.Write(tosend)
-	base.Forward(receiver, sender)
-}
-
-func clientAuth(conn net.Conn) error {
-	var buf [2]byte
-	conn.Write([]byte{5, 1, 0})
-	_, err := io.ReadFull(conn, buf[:2])
-	if err != nil {
-		return err
-	}
-	if buf[0] != 5 || buf[1] != 0 {
-		return err
-	}
-	return nil
-}
-
-func clientConnect(sender net.Conn, atyp int, addr string, port uint16) (bnd_addr string, bnd_port uint16, e error) {
-	sender.Write([]byte{5, 1, 0, byte(atyp)})
-	// hostname
-	if atyp == 3 {
-		sender.Write([]byte{uint8(len(addr))})
-		sender.Write([]byte(addr))
-	} else if atyp == 1 { // ipv4
-		ip := net.ParseIP(addr)
-		sender.Write([]byte(ip.To4()))
-	} else {
-		ip := net.ParseIP(addr)
-		sender.Write([]byte(ip.To16()))
-	}
-	var buf [256]byte
-	binary.BigEndian.PutUint16(buf[:2], port)
-	sender.Write(buf[:2])
-
-	io.ReadFull(sender, buf[:2])
-	if buf[0] != 5 || buf[1] != 0 {
-		e = fmt.Errorf("reply code: %d", buf[1])
-		return
-	}
-	io.ReadFull(sender, buf[:2])
-	switch buf[1] {
-	// ipv4
-	case 1:
-		io.ReadFull(sender, buf[:4])
-		ip := net.IPv4(buf[0], buf[1], buf[2], buf[3])
-		bnd_addr = ip.String()
-	// ipv6
-	case 4:
-		io.ReadFull(sender, buf[:16])
-		ip := net.IP{buf[0], buf[1], buf[2], buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10], buf[11], buf[12], buf[13], buf[14], buf[15]}
-		bnd_addr = ip.String()
-	// hostname
-	case 3:
-		io.ReadFull(sender, buf[:1])
-		le := uint8(buf[0])
-		io.ReadFull(sender, buf[:le])
-		bnd_addr = string(buf[:le])
-	default:
-		e = errors.New("invalid aytp")
-		return
-	}
-
-	io.ReadFull(sender, buf[:2])
-	bnd_port = binary.BigEndian.Uint16(buf[:2])
-	return
+	sender.Write(req.tosend)
+	base.Forward(req.conn, sender)
 }
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"proxy/base"
+	"strconv"
+)
+
+// ContextDialer mirrors the interface of the same name in
+// golang.org/x/net/proxy, so a *Dialer can be used wherever that one is
+// expected, e.g. as net/http.Transport.DialContext.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer tunnels TCP connections through a chain of SOCKS5 servers. The
+// first server is dialed directly and every following one is reached
+// through a CONNECT on the previous.
+type Dialer struct {
+	chain []string
+	// Forward dials the first hop. A zero net.Dialer is used when nil.
+	Forward ContextDialer
+}
+
+var _ ContextDialer = (*Dialer)(nil)
+
+// NewDialer builds a Dialer from a chain of "ip:port" proxy addresses.
+func NewDialer(chain []string) (*Dialer, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("empty proxy chain")
+	}
+	for _, addr := range chain {
+		if !checkAddr(addr) {
+			return nil, errors.New("invalid proxy address: " + addr)
+		}
+	}
+	d := &Dialer{chain: make([]string, len(chain))}
+	copy(d.chain, chain)
+	return d, nil
+}
+
+// Chain returns the proxy addresses the Dialer goes through.
+func (d *Dialer) Chain() []string {
+	return append([]string(nil), d.chain...)
+}
+
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("unsupported network: " + network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port: " + portStr)
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.chain[0])
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(d.chain); i++ {
+		pAddr, pPortStr, _ := net.SplitHostPort(d.chain[i])
+		pPort, _ := strconv.Atoi(pPortStr)
+		_, err = base.HandshakeContext(ctx, conn, pAddr, uint16(pPort))
+		if err != nil {
+			conn.Close()
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: hopAddr(d.chain[i]), Err: err}
+		}
+	}
+	_, err = base.HandshakeContext(ctx, conn, host, uint16(port))
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: hopAddr(addr), Err: err}
+	}
+	return conn, nil
+}
+
+type hopAddr string
+
+func (a hopAddr) Network() string { return "tcp" }
+func (a hopAddr) String() string  { return string(a) }
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"net"
+	"proxy/dns"
+)
+
+// DNSServer builds a DNS server from conf. Names matched by the hostname or
+// HTTP keywords go DIRECT and are resolved by the local upstream, all
+// others are resolved through the proxy chain, or get a fake-ip address if
+// conf enables it. In that case c.FakeIP is set so connections to those
+// addresses are turned back into connections to the names.
+func (c *Client) DNSServer(conf *dns.Config) (*dns.Server, error) {
+	local, err := dns.ParseUpstream(conf.Local, nil)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := dns.ParseUpstream(conf.Proxy, c.dialChain)
+	if err != nil {
+		return nil, err
+	}
+	s := &dns.Server{
+		Route: c.proxiedName,
+		Local: local,
+		Proxy: proxy,
+	}
+	switch conf.Fallback {
+	case "local":
+		s.Fallback = s.Local
+	case "proxy":
+		s.Fallback = s.Proxy
+	}
+	if conf.CacheSize > 0 {
+		s.Cache = dns.NewCache(conf.CacheSize)
+		s.Cache.MinTTL = conf.MinTTL
+		s.Cache.MaxTTL = conf.MaxTTL
+	}
+	if conf.FakeIP != "" {
+		fake, err := dns.NewFakeIP(conf.FakeIP, conf.FakeIPSize)
+		if err != nil {
+			return nil, err
+		}
+		if err = fake.Load(conf.FakeIPFile); err != nil {
+			return nil, err
+		}
+		s.FakeIP = fake
+		c.FakeIP = fake
+	}
+	return s, nil
+}
+
+// proxiedName reports whether connections to name would be proxied.
+func (c *Client) proxiedName(name string) bool {
+	rule := c.rules()
+	if isMatch, _ := rule.MatchKeyword(name); isMatch {
+		return false
+	}
+	if isMatch, _ := rule.MatchHttpHost(name); isMatch {
+		return false
+	}
+	return true
+}
+
+func (c *Client) dialChain(ctx context.Context, network, addr string) (net.Conn, error) {
+	d, err := c.Dialer()
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
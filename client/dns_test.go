@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"proxy/dns"
+)
+
+// localResolver answers every A query with 192.0.2.1 over UDP.
+func localResolver(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := dns.Parse(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, _ := m.Question()
+			rr := dns.RR{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET, TTL: 60, Data: []byte{192, 0, 2, 1}}
+			resp, _ := dns.AnswerReply(m, dns.RcodeSuccess, []dns.RR{rr})
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSServer(t *testing.T) {
+	dir := t.TempDir()
+	var r Rules
+	socks, http := filepath.Join(dir, "socksRule.db"), filepath.Join(dir, "httpRule.db")
+	if err := os.WriteFile(socks, []byte("ON\nexample.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(http, []byte("ON\ncdn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ParseRules(socks); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ParseHttpRules(http); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{ProxyAddr: []string{"127.0.0.1:1"}, rule: &r}
+	conf := &dns.Config{
+		Local:      localResolver(t),
+		Proxy:      "8.8.8.8:53",
+		Fallback:   "local",
+		CacheSize:  16,
+		FakeIP:     "198.18.0.0/15",
+		FakeIPSize: 16,
+		FakeIPFile: filepath.Join(dir, "fakeip.db"),
+	}
+	s, err := c.DNSServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Local.(*dns.UDPUpstream); !ok {
+		t.Errorf("local upstream %T", s.Local)
+	}
+	// plain DNS through the proxy chain goes over TCP
+	if _, ok := s.Proxy.(*dns.TCPUpstream); !ok {
+		t.Errorf("proxy upstream %T", s.Proxy)
+	}
+	if s.Fallback != s.Local || s.Cache == nil || s.FakeIP == nil || c.FakeIP != s.FakeIP {
+		t.Errorf("server %+v", s)
+	}
+	for name, proxied := range map[string]bool{
+		"www.example.com": false,
+		"img.cdn.net":     false,
+		"example.org":     true,
+	} {
+		if s.Route(name) != proxied {
+			t.Errorf("%s: proxied %v, want %v", name, !proxied, proxied)
+		}
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go s.ServeUDP(pc)
+	client := &dns.UDPUpstream{Addr: pc.LocalAddr().String()}
+	lookup := func(name string) net.IP {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		q, _ := dns.NewQuery(1, name, dns.TypeA)
+		resp, err := client.Exchange(ctx, q)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		m, err := dns.Parse(resp)
+		if err != nil || len(m.IPs()) != 1 {
+			t.Fatalf("%s: got %+v, %v", name, m, err)
+		}
+		return m.IPs()[0]
+	}
+	if ip := lookup("www.example.com"); !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("direct name resolved to %s", ip)
+	}
+	ip := lookup("example.org")
+	if name, ok := c.FakeIP.Name(ip); !ok || name != "example.org" {
+		t.Errorf("proxied name got %s, mapped to %q", ip, name)
+	}
+}
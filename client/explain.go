@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Query is a destination to be evaluated against the rules without
+// connecting anywhere.
+type Query struct {
+	Host string
+	Port uint16
+	// command line of the connecting process, optional
+	Program string
+	// the connecting process, optional; takes precedence over Program
+	Process *Process
+	// Host header or TLS server name sent by the application, optional
+	SNI string
+}
+
+// Step is the outcome of one rule group during an evaluation.
+type Step struct {
+	Rule    string
+	Enabled bool
+	Skipped string
+	Matched bool
+	Key     string
+}
+
+// Trace is the evaluation of a Query in the order the client applies the
+// rules for a real connection.
+type Trace struct {
+	Query  Query
+	Steps  []Step
+	Action string
+	Info   string
+	// outbound profile for DIRECT, "" for the default
+	Outbound string
+	Upstream []string
+}
+
+// Explain evaluates q against the rules. Upstream is left empty.
+func (r *Rules) Explain(q Query) *Trace {
+	t := &Trace{Query: q, Action: "PROXY"}
+	check := func(step Step) bool {
+		t.Steps = append(t.Steps, step)
+		if step.Matched {
+			t.Action = "DIRECT"
+			t.Info = "match " + step.Rule + ": " + step.Key
+			t.Outbound = r.Outbound(step.Rule, step.Key)
+		}
+		return step.Matched
+	}
+
+	// programRule
+	step := Step{Rule: ruleProgram, Enabled: r.programEnabled()}
+	p := q.Process
+	if p == nil && q.Program != "" {
+		p = &Process{PID: -1, Cmdline: q.Program, UID: -1, GID: -1, PPID: -1}
+	}
+	if step.Enabled && p == nil {
+		step.Skipped = "no program given"
+	} else if p != nil {
+		step.Matched, step.Key = r.MatchProcess(p)
+	}
+	if check(step) {
+		return t
+	}
+
+	// addressRule
+	ip := net.ParseIP(q.Host)
+	if ip == nil {
+		step = Step{Rule: ruleHostname, Enabled: r.addrON}
+		step.Matched, step.Key = r.MatchKeyword(q.Host)
+	} else {
+		step = Step{Rule: ruleCIDR, Enabled: r.addrON}
+		step.Matched, step.Key = r.MatchCIDR(ip)
+	}
+	if check(step) {
+		return t
+	}
+
+	// httpRule
+	step = Step{Rule: ruleHttp, Enabled: r.HttpEnabled()}
+	if step.Enabled && q.SNI == "" {
+		step.Skipped = "no Host or SNI given"
+	} else {
+		step.Matched, step.Key = r.MatchHttpHost(q.SNI)
+	}
+	check(step)
+	return t
+}
+
+// Explain evaluates q against the loaded rules and reports the proxy chain
+// that would be used.
+func (c *Client) Explain(q Query) *Trace {
+	t := c.rules().Explain(q)
+	if t.Action == "PROXY" {
+		t.Upstream = append(t.Upstream, c.ProxyAddr...)
+	}
+	return t
+}
+
+func (t *Trace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "destination: %s\n", net.JoinHostPort(t.Query.Host, fmt.Sprint(t.Query.Port)))
+	for _, step := range t.Steps {
+		state := "no match"
+		switch {
+		case !step.Enabled:
+			state = "disabled"
+		case step.Skipped != "":
+			state = "skipped, " + step.Skipped
+		case step.Matched:
+			state = "MATCH " + step.Key
+		}
+		fmt.Fprintf(&b, "  %-16s %s\n", step.Rule, state)
+	}
+	if t.Action == "DIRECT" && t.Outbound != "" {
+		fmt.Fprintf(&b, "action: DIRECT via outbound %s (%s)\n", t.Outbound, t.Info)
+	} else if t.Action == "DIRECT" {
+		fmt.Fprintf(&b, "action: DIRECT (%s)\n", t.Info)
+	} else {
+		fmt.Fprintf(&b, "action: PROXY via %s\n", strings.Join(t.Upstream, " -> "))
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func explainRules(t *testing.T) *Rules {
+	t.Helper()
+	dir := t.TempDir()
+	var r Rules
+	for _, f := range []struct {
+		name, data string
+		parse      func(string) error
+	}{
+		{"socksRule.db", "ON\nexample.com@work 10.0.0.0/8\n", r.ParseRules},
+		{"programRule.db", "ON\ncurl@work PROCESS-NAME,wget\n", r.ParseProgramRules},
+		{"httpRule.db", "ON\ntracker\n", r.ParseHttpRules},
+	} {
+		name := filepath.Join(dir, f.name)
+		if err := os.WriteFile(name, []byte(f.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.parse(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &r
+}
+
+func TestExplain(t *testing.T) {
+	r := explainRules(t)
+	program := func(matched bool, key, skipped string) Step {
+		return Step{Rule: ruleProgram, Enabled: true, Matched: matched, Key: key, Skipped: skipped}
+	}
+	hostname := func(matched bool, key string) Step {
+		return Step{Rule: ruleHostname, Enabled: true, Matched: matched, Key: key}
+	}
+	cidr := func(matched bool, key string) Step {
+		return Step{Rule: ruleCIDR, Enabled: true, Matched: matched, Key: key}
+	}
+	http := func(matched bool, key, skipped string) Step {
+		return Step{Rule: ruleHttp, Enabled: true, Matched: matched, Key: key, Skipped: skipped}
+	}
+	tests := []struct {
+		name     string
+		q        Query
+		steps    []Step
+		action   string
+		info     string
+		outbound string
+	}{
+		{
+			"program keyword",
+			Query{Host: "example.org", Program: "/usr/bin/curl -s example.org"},
+			[]Step{program(true, "curl", "")},
+			"DIRECT", "match ProgramRule: curl", "work",
+		},
+		{
+			"process name",
+			Query{Host: "example.org", Process: &Process{PID: 7, Cmdline: "wget x", Name: "wget", UID: -1, GID: -1}},
+			[]Step{program(true, "PROCESS-NAME,wget", "")},
+			"DIRECT", "match ProgramRule: PROCESS-NAME,wget", "",
+		},
+		{
+			"hostname",
+			Query{Host: "www.example.com"},
+			[]Step{program(false, "", "no program given"), hostname(true, "example.com")},
+			"DIRECT", "match HostnameKeyword: example.com", "work",
+		},
+		{
+			"cidr",
+			Query{Host: "10.1.2.3", Program: "firefox"},
+			[]Step{program(false, "", ""), cidr(true, "10.0.0.0/8")},
+			"DIRECT", "match CIDR: 10.0.0.0/8", "",
+		},
+		{
+			"sni",
+			Query{Host: "192.0.2.1", SNI: "api.tracker.net"},
+			[]Step{program(false, "", "no program given"), cidr(false, ""), http(true, "tracker", "")},
+			"DIRECT", "match HttpKeyword: tracker", "",
+		},
+		{
+			"no sni",
+			Query{Host: "example.org"},
+			[]Step{program(false, "", "no program given"), hostname(false, ""), http(false, "", "no Host or SNI given")},
+			"PROXY", "", "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trace := r.Explain(tt.q)
+			if !reflect.DeepEqual(trace.Steps, tt.steps) {
+				t.Errorf("steps %+v, want %+v", trace.Steps, tt.steps)
+			}
+			if trace.Action != tt.action || trace.Info != tt.info || trace.Outbound != tt.outbound {
+				t.Errorf("got %s %q @%q, want %s %q @%q", trace.Action, trace.Info, trace.Outbound, tt.action, tt.info, tt.outbound)
+			}
+		})
+	}
+}
+
+func TestTraceString(t *testing.T) {
+	c := &Client{ProxyAddr: []string{"192.0.2.10:1080", "192.0.2.11:1080"}, rule: explainRules(t)}
+	c.rule.progON = false
+	got := c.Explain(Query{Host: "example.org", Port: 443, SNI: "example.org"}).String()
+	want := "destination: example.org:443\n" +
+		"  ProgramRule      disabled\n" +
+		"  HostnameKeyword  no match\n" +
+		"  HttpKeyword      no match\n" +
+		"action: PROXY via 192.0.2.10:1080 -> 192.0.2.11:1080\n"
+	if got != want {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+	got = c.Explain(Query{Host: "mail.example.com", Port: 25}).String()
+	want = "destination: mail.example.com:25\n" +
+		"  ProgramRule      disabled\n" +
+		"  HostnameKeyword  MATCH example.com\n" +
+		"action: DIRECT via outbound work (match HostnameKeyword: example.com)\n"
+	if got != want {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+}
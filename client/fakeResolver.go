@@ -0,0 +1,47 @@
+package client
+
+import (
+	"net"
+	"sync"
+)
+
+// FakeResolver is an in-memory ProcessResolver, for tests and for callers
+// that know the owners of their sockets without procfs. The zero value is
+// ready to use.
+type FakeResolver struct {
+	mu    sync.Mutex
+	procs map[string]Process
+}
+
+var _ ProcessResolver = (*FakeResolver)(nil)
+
+func fakeKey(network string, app, us net.Addr) string {
+	return network + " " + app.String() + " " + us.String()
+}
+
+// Add registers p as the owner of the socket app -> us.
+func (f *FakeResolver) Add(network string, app, us net.Addr, p Process) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.procs == nil {
+		f.procs = make(map[string]Process)
+	}
+	f.procs[fakeKey(network, app, us)] = p
+}
+
+// Remove forgets the socket app -> us, as if its owner had exited.
+func (f *FakeResolver) Remove(network string, app, us net.Addr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.procs, fakeKey(network, app, us))
+}
+
+func (f *FakeResolver) Lookup(network string, app, us net.Addr) (*Process, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.procs[fakeKey(network, app, us)]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchCmd(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "programRule.db")
+	if err := os.WriteFile(rules, []byte("ON\ncurl PROCESS-NAME,wget UID,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var r Rules
+	if err := r.ParseProgramRules(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		app, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer app.Close()
+		us, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer us.Close()
+		conns = append(conns, us)
+	}
+
+	var fake FakeResolver
+	add := func(conn net.Conn, p Process) {
+		fake.Add("tcp", conn.RemoteAddr(), conn.LocalAddr(), p)
+	}
+	add(conns[0], Process{PID: 1, Cmdline: "/usr/bin/curl -s example.com", UID: 1000})
+	add(conns[1], Process{PID: 2, Cmdline: "wget example.com", Name: "wget", UID: 1000})
+	add(conns[2], Process{PID: 3, Cmdline: "sshd", Name: "sshd", UID: 0})
+	add(conns[3], Process{PID: 4, Cmdline: "firefox", Name: "firefox", UID: 1000})
+	fake.Remove("tcp", conns[3].RemoteAddr(), conns[3].LocalAddr())
+
+	tests := []struct {
+		match bool
+		key   string
+	}{
+		{true, "curl"},
+		{true, "PROCESS-NAME,wget"},
+		{true, "UID,0"},
+		// the process exited
+		{false, ""},
+	}
+	for i, tt := range tests {
+		match, key, err := r.MatchCmd(conns[i], &fake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != tt.match || key != tt.key {
+			t.Errorf("conn %d: got %v %q, want %v %q", i, match, key, tt.match, tt.key)
+		}
+	}
+}
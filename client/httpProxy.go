@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// handleHTTP serves an HTTP proxy request: CONNECT is tunneled, absolute-URI
+// requests are forwarded in origin form. Both go through the same rules as
+// SOCKS5 requests.
+func (c *Client) handleHTTP(conn *bufConn) {
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		fmt.Println("Failed to read HTTP request:", err)
+		conn.Close()
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		atyp, addr, port, err := splitDest(req.Host, 443)
+		if err != nil {
+			writeHTTPError(conn, http.StatusBadRequest)
+			conn.Close()
+			return
+		}
+		c.dispatch(&request{conn: conn, fe: httpFrontend{tunnel: true}, atyp: atyp, addr: addr, port: port})
+		return
+	}
+
+	if req.URL.Host == "" {
+		// a request to the client itself rather than through it
+		if req.URL.Path == "/proxy.pac" || req.URL.Path == "/wpad.dat" {
+			c.servePAC(conn)
+		} else {
+			writeHTTPError(conn, http.StatusNotFound)
+		}
+		conn.Close()
+		return
+	}
+	atyp, addr, port, err := splitDest(req.URL.Host, 80)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest)
+		conn.Close()
+		return
+	}
+	c.dispatch(&request{conn: conn, fe: httpFrontend{}, atyp: atyp, addr: addr, port: port, tosend: originRequest(req)})
+}
+
+func (c *Client) servePAC(conn net.Conn) {
+	pac := c.PAC(conn.LocalAddr().String())
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/x-ns-proxy-autoconfig\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", len(pac))
+	conn.Write([]byte(pac))
+}
+
+// originRequest rewrites the header of a proxy request for the origin
+// server. The body is left unread in the connection and relayed as is.
+// Keep-alive is turned off so every request is routed on its own.
+func originRequest(req *http.Request) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	if len(req.TransferEncoding) > 0 {
+		fmt.Fprintf(&b, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", "))
+	}
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Set("Connection", "close")
+	req.Header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// splitDest parses a host[:port] into the SOCKS5 address form.
+func splitDest(hostport string, defaultPort uint16) (atyp int, addr string, port uint16, err error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// no port
+		host, portStr, err = strings.Trim(hostport, "[]"), strconv.Itoa(int(defaultPort)), nil
+	}
+	num, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return
+	}
+	port = uint16(num)
+	addr = host
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		atyp = 3
+	case ip.To4() != nil:
+		atyp = 1
+	default:
+		atyp = 4
+	}
+	return
+}
+
+func writeHTTPError(conn net.Conn, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
+
+type httpFrontend struct {
+	tunnel bool
+}
+
+func (f httpFrontend) ready(conn net.Conn, bnd net.Addr) error {
+	if !f.tunnel {
+		return nil
+	}
+	_, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return err
+}
+
+func (f httpFrontend) fail(conn net.Conn, err error) {
+	writeHTTPError(conn, http.StatusBadGateway)
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"proxy/base"
+)
+
+// directClient returns a client sending localhost DIRECT, serving one
+// shared SOCKS5 and HTTP port.
+func directClient(t *testing.T) net.Listener {
+	t.Helper()
+	dir := t.TempDir()
+	files := RuleFiles{
+		Socks:   filepath.Join(dir, "socksRule.db"),
+		Program: filepath.Join(dir, "programRule.db"),
+		Http:    filepath.Join(dir, "httpRule.db"),
+	}
+	for name, data := range map[string]string{
+		files.Socks:   "ON\n127.0.0.0/8 localhost\n",
+		files.Program: "OFF\n",
+		files.Http:    "OFF\n",
+	} {
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &Client{RuleFiles: files, Resolver: &FakeResolver{}}
+	if err := c.ParseRules(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go c.serveConn(conn)
+		}
+	}()
+	return l
+}
+
+// echoBackend answers with the method, request URI and proxy headers it
+// received.
+func echoBackend(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method+" "+r.RequestURI+" proxy-connection="+r.Header.Get("Proxy-Connection"))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// get sends a GET for path over conn, which is already connected to the
+// backend, and returns the body.
+func get(t *testing.T, conn net.Conn, host, path string) string {
+	t.Helper()
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestSharedPortSocks(t *testing.T) {
+	l := directClient(t)
+	backend := echoBackend(t)
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := base.HandshakeContext(context.Background(), conn, host, uint16(port)); err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		if got := get(t, conn, u.Host, "/socks"); got != "GET /socks proxy-connection=" {
+			t.Errorf("%s: got %q", host, got)
+		}
+	}
+}
+
+func TestSharedPortConnect(t *testing.T) {
+	l := directClient(t)
+	backend := echoBackend(t)
+	u, _ := url.Parse(backend.URL)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+u.Host+" HTTP/1.1\r\nHost: "+u.Host+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "HTTP/1.1 200 ") {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	if line, _ = br.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("unexpected header %q", line)
+	}
+	if got := get(t, conn, u.Host, "/tunnel?x=1"); got != "GET /tunnel?x=1 proxy-connection=" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSharedPortAbsoluteURI(t *testing.T) {
+	l := directClient(t)
+	backend := echoBackend(t)
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	req, _ := http.NewRequest(http.MethodGet, backend.URL+"/page?q=1", nil)
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	// the origin gets an origin-form request without proxy headers
+	if string(body) != "GET /page?q=1 proxy-connection=" {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestSharedPortErrors(t *testing.T) {
+	l := directClient(t)
+	tests := []struct {
+		request string
+		status  int
+	}{
+		{"CONNECT 127.0.0.1:99999 HTTP/1.1\r\nHost: x\r\n\r\n", http.StatusBadRequest},
+		{"GET http://127.0.0.1:99999/ HTTP/1.1\r\nHost: x\r\n\r\n", http.StatusBadRequest},
+		{"GET /missing HTTP/1.1\r\nHost: x\r\n\r\n", http.StatusNotFound},
+		{"GET /proxy.pac HTTP/1.1\r\nHost: x\r\n\r\n", http.StatusOK},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, tt.request)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Errorf("%q: %v", tt.request, err)
+			continue
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.request, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestSplitDest(t *testing.T) {
+	tests := []struct {
+		in   string
+		atyp int
+		addr string
+		port uint16
+	}{
+		{"example.com", 3, "example.com", 80},
+		{"example.com:8080", 3, "example.com", 8080},
+		{"10.0.0.1:443", 1, "10.0.0.1", 443},
+		{"[2001:db8::1]:443", 4, "2001:db8::1", 443},
+		{"[2001:db8::1]", 4, "2001:db8::1", 80},
+	}
+	for _, tt := range tests {
+		atyp, addr, port, err := splitDest(tt.in, 80)
+		if err != nil || atyp != tt.atyp || addr != tt.addr || port != tt.port {
+			t.Errorf("%s: got %d %s %d %v", tt.in, atyp, addr, port, err)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package client
 import (
 	"bufio"
 	"errors"
-	"net"
 	"os"
 	"strings"
 )
@@ -30,24 +29,29 @@ func (r *Rules) ParseHttpRules(name string) error {
 	}
 
 	for scanner.Scan() {
-		word := scanner.Text()
+		word, profile := splitOutbound(scanner.Text())
 		r.http[word] = true
+		r.setOutbound(ruleHttp, word, profile)
 	}
 	return nil
 }
 
-func (r *Rules) MatchHttp(conn net.Conn) (res bool, key string, tosend []byte) {
+func (r *Rules) HttpEnabled() bool {
+	return r.httpON && len(r.http) > 0
+}
+
+// MatchHttp looks for a keyword in the Host header of a plain HTTP request,
+// or anywhere in the first bytes of other traffic such as a TLS ClientHello.
+func (r *Rules) MatchHttp(data []byte) (res bool, key string) {
 	res = false
-	if !r.httpON || len(r.http) == 0 {
+	if !r.HttpEnabled() {
 		return
 	}
-	var buf [1024]byte
-	n, _ := conn.Read(buf[:1024])
-	tosend = append(tosend, buf[:n]...)
-	if !strings.Contains(string(buf[:n]), "HTTP") {
+	n := len(data)
+	if !strings.Contains(string(data), "HTTP") {
 		// HTTPS
 		for keyword := range r.http {
-			if strings.Contains(string(tosend), keyword) {
+			if strings.Contains(string(data), keyword) {
 				res = true
 				key = keyword
 				return
@@ -57,8 +61,8 @@ func (r *Rules) MatchHttp(conn net.Conn) (res bool, key string, tosend []byte) {
 	}
 	line := ""
 	for i := 0; i < n; i++ {
-		if buf[i] != '\r' && buf[i] != '\n' {
-			line = line + string(buf[i])
+		if data[i] != '\r' && data[i] != '\n' {
+			line = line + string(data[i])
 			continue
 		}
 		if strings.Contains(line, "Host: ") {
@@ -75,3 +79,17 @@ func (r *Rules) MatchHttp(conn net.Conn) (res bool, key string, tosend []byte) {
 	}
 	return
 }
+
+// MatchHttpHost matches a Host header value or TLS server name against the
+// HTTP keywords.
+func (r *Rules) MatchHttpHost(host string) (bool, string) {
+	if !r.HttpEnabled() {
+		return false, ""
+	}
+	for keyword := range r.http {
+		if strings.Contains(host, keyword) {
+			return true, keyword
+		}
+	}
+	return false, ""
+}
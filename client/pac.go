@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// PAC returns a proxy auto-config script sending hosts matched by the
+// address and HTTP keyword rules DIRECT and everything else to the client
+// listening on proxyAddr. Program rules cannot be expressed in PAC.
+func (r *Rules) PAC(proxyAddr string) string {
+	var keywords []string
+	if r.addrON {
+		for key := range r.keyword {
+			keywords = append(keywords, key)
+		}
+	}
+	// the Host header or SNI usually equals the requested host
+	if r.HttpEnabled() {
+		for key := range r.http {
+			keywords = append(keywords, key)
+		}
+	}
+	var v4, v6 []string
+	if r.addrON {
+		for ipNet := range r.cidr {
+			if ipNet.IP.To4() != nil {
+				v4 = append(v4, "["+jsString(ipNet.IP.String())+", "+jsString(net.IP(ipNet.Mask).String())+"]")
+			} else {
+				v6 = append(v6, jsString(ipNet.String()))
+			}
+		}
+	}
+	sort.Strings(keywords)
+	sort.Strings(v4)
+	sort.Strings(v6)
+	quoted := make([]string, len(keywords))
+	for i, key := range keywords {
+		quoted[i] = jsString(key)
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "\tvar keywords = [%s];\n", strings.Join(quoted, ", "))
+	fmt.Fprintf(&b, "\tvar cidrs = [%s];\n", strings.Join(v4, ", "))
+	fmt.Fprintf(&b, "\tvar cidrs6 = [%s];\n", strings.Join(v6, ", "))
+	b.WriteString(`	var i;
+	if (/^\d+\.\d+\.\d+\.\d+$/.test(host)) {
+		for (i = 0; i < cidrs.length; i++) {
+			if (isInNet(host, cidrs[i][0], cidrs[i][1])) {
+				return "DIRECT";
+			}
+		}
+	} else if (host.indexOf(":") >= 0) {
+		if (typeof isInNetEx == "function") {
+			for (i = 0; i < cidrs6.length; i++) {
+				if (isInNetEx(host, cidrs6[i])) {
+					return "DIRECT";
+				}
+			}
+		}
+	} else {
+		for (i = 0; i < keywords.length; i++) {
+			if (host.indexOf(keywords[i]) >= 0) {
+				return "DIRECT";
+			}
+		}
+	}
+`)
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", jsString("PROXY "+proxyAddr+"; SOCKS5 "+proxyAddr))
+	return b.String()
+}
+
+// jsString quotes s as a JavaScript string literal. JSON strings are valid
+// JavaScript, Go's %q escapes are not.
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// PAC returns the PAC script for the currently loaded rules.
+func (c *Client) PAC(proxyAddr string) string {
+	return c.rules().PAC(proxyAddr)
+}
+
+// WritePAC writes the PAC script for the currently loaded rules to name.
+func (c *Client) WritePAC(name, proxyAddr string) error {
+	return os.WriteFile(name, []byte(c.PAC(proxyAddr)), 0644)
+}
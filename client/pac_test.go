@@ -0,0 +1,50 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPAC(t *testing.T) {
+	dir := t.TempDir()
+	socks, http := filepath.Join(dir, "socksRule.db"), filepath.Join(dir, "httpRule.db")
+	// U+E0001 is not printable, Go quotes it as \U000e0001 which is not
+	// a JavaScript escape
+	if err := os.WriteFile(socks, []byte("ON\nexample.com 10.0.0.0/8 2001:db8::/32 \"quoted\" tag\U000E0001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(http, []byte("ON\ntracker\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var r Rules
+	if err := r.ParseRules(socks); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ParseHttpRules(http); err != nil {
+		t.Fatal(err)
+	}
+	pac := r.PAC("127.0.0.1:1080")
+
+	for _, want := range []string{
+		`	var keywords = ["\"quoted\"", "example.com", "tag` + "\U000E0001" + `", "tracker"];` + "\n",
+		`	var cidrs = [["10.0.0.0", "255.0.0.0"]];` + "\n",
+		`	var cidrs6 = ["2001:db8::/32"];` + "\n",
+		`	return "PROXY 127.0.0.1:1080; SOCKS5 127.0.0.1:1080";` + "\n",
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("missing %q in\n%s", want, pac)
+		}
+	}
+	if strings.Contains(pac, `\U`) || strings.Contains(pac, `\x`) {
+		t.Errorf("Go escapes in\n%s", pac)
+	}
+
+	// rules that are off are left out
+	r.addrON, r.httpON = false, false
+	pac = r.PAC("127.0.0.1:1080")
+	if !strings.Contains(pac, "var keywords = [];") || !strings.Contains(pac, "var cidrs = [];") {
+		t.Errorf("disabled rules in\n%s", pac)
+	}
+}
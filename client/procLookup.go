@@ -0,0 +1,442 @@
+package client
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Process describes the local process behind a connection. Numeric fields
+// are -1 and strings empty when unknown.
+type Process struct {
+	PID     int
+	Cmdline string
+	// basename of Path, or the kernel's comm if the executable is unreadable
+	Name string
+	// resolved /proc/<pid>/exe
+	Path       string
+	UID        int
+	GID        int
+	Cgroup     string
+	PPID       int
+	ParentName string
+}
+
+// ProcessResolver finds the local process owning a socket.
+type ProcessResolver interface {
+	// Lookup returns the process owning the "tcp" or "udp" socket
+	// app -> us, or nil if there is none.
+	Lookup(network string, app, us net.Addr) (*Process, error)
+}
+
+// DefaultResolver reads the /proc of the running system.
+var DefaultResolver ProcessResolver = NewProcFS("/proc")
+
+// ProcFS resolves processes from a procfs mounted at a configurable root,
+// e.g. the host's /proc bind-mounted into a container. The socket inode is
+// asked from the kernel through sock_diag when root is the local /proc, and
+// read from root/net otherwise.
+type ProcFS struct {
+	root     string
+	sockDiag bool
+	index    *procIndex
+}
+
+func NewProcFS(root string) *ProcFS {
+	root = filepath.Clean(root)
+	return &ProcFS{root: root, sockDiag: root == "/proc", index: newProcIndex(root, 1024)}
+}
+
+func (fs *ProcFS) Lookup(network string, app, us net.Addr) (*Process, error) {
+	uid := -1
+	var inode uint32
+	var err error
+	if fs.sockDiag {
+		var sockUID uint32
+		inode, sockUID, err = sockDiag(network, app, us)
+		if err == nil {
+			uid = int(sockUID)
+		}
+	}
+	if !fs.sockDiag || err != nil {
+		// sock_diag unavailable, fall back to /proc/net
+		inode, err = procNetInode(fs.root, network, app, us)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if inode == 0 {
+		return nil, nil
+	}
+	p, err := fs.index.process(inode)
+	if p == nil || err != nil {
+		return nil, err
+	}
+	if uid >= 0 {
+		// the socket owner, which is what the kernel accounts it to
+		p.UID = uid
+	}
+	return p, nil
+}
+
+// procIndex resolves socket inodes to processes. It keeps an inode -> pid
+// index read from the fd symlinks of every process, and an LRU cache of
+// the processes found. Inodes are reused once a socket is closed, so both
+// are trusted only while the fd they were found at still links to the
+// inode. A new socket is usually opened by a process that already exists,
+// so on a miss the fds of known processes are read again, most recently
+// seen first, until the inode turns up. Only when processes have started
+// since the index was built is the whole index rebuilt instead.
+type procIndex struct {
+	root  string
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	cache map[uint32]*list.Element
+
+	indexMu sync.Mutex
+	owners  map[uint32]socketFd
+	sockets map[int][]uint32 // inodes per pid in owners
+	pids    map[int]bool     // every pid the index has read
+	seen    map[int]uint64   // when a pid was last found, by tick
+	tick    uint64
+}
+
+// socketFd is the file descriptor fd of pid.
+type socketFd struct {
+	pid int
+	fd  string
+}
+
+// holds reports whether s still links to the socket inode.
+func (s socketFd) holds(root string, inode uint32) bool {
+	link, err := os.Readlink(fmt.Sprintf("%s/%d/fd/%s", root, s.pid, s.fd))
+	return err == nil && link == fmt.Sprintf("socket:[%d]", inode)
+}
+
+type procEntry struct {
+	inode uint32
+	owner socketFd
+	proc  Process
+}
+
+func newProcIndex(root string, size int) *procIndex {
+	return &procIndex{
+		root:    root,
+		size:    size,
+		order:   list.New(),
+		cache:   make(map[uint32]*list.Element),
+		owners:  make(map[uint32]socketFd),
+		sockets: make(map[int][]uint32),
+		pids:    make(map[int]bool),
+		seen:    make(map[int]uint64),
+	}
+}
+
+// process returns a copy of the process holding the socket inode, or nil.
+func (p *procIndex) process(inode uint32) (*Process, error) {
+	p.mu.Lock()
+	if e, ok := p.cache[inode]; ok {
+		entry := e.Value.(*procEntry)
+		if entry.owner.holds(p.root, inode) {
+			p.order.MoveToFront(e)
+			proc := entry.proc
+			p.mu.Unlock()
+			return &proc, nil
+		}
+		// closed, the inode may belong to another process now
+		p.order.Remove(e)
+		delete(p.cache, inode)
+	}
+	p.mu.Unlock()
+
+	owner, ok, err := p.owner(inode)
+	if !ok || err != nil {
+		return nil, err
+	}
+	proc, err := readProcess(p.root, owner.pid)
+	if err != nil {
+		// the process exited in between
+		p.indexMu.Lock()
+		p.setSockets(owner.pid, nil)
+		p.indexMu.Unlock()
+		return nil, nil
+	}
+	p.add(inode, owner, *proc)
+	return proc, nil
+}
+
+// owner returns the fd holding inode, updating the index on a miss.
+func (p *procIndex) owner(inode uint32) (socketFd, bool, error) {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+	if s, ok := p.owners[inode]; ok {
+		if s.holds(p.root, inode) {
+			p.found(s.pid)
+			return s, true, nil
+		}
+		p.rescan(s.pid)
+	}
+
+	pids, err := listPids(p.root)
+	if err != nil {
+		return socketFd{}, false, err
+	}
+	alive := make(map[int]bool, len(pids))
+	stale := false
+	for _, pid := range pids {
+		alive[pid] = true
+		if !p.pids[pid] {
+			stale = true
+		}
+	}
+	if stale {
+		p.rebuild(pids)
+		s, ok := p.owners[inode]
+		if ok {
+			p.found(s.pid)
+		}
+		return s, ok, nil
+	}
+
+	known := make([]int, 0, len(p.pids))
+	for pid := range p.pids {
+		if alive[pid] {
+			known = append(known, pid)
+		} else {
+			p.setSockets(pid, nil)
+			delete(p.pids, pid)
+		}
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return p.seen[known[i]] > p.seen[known[j]]
+	})
+	for _, pid := range known {
+		p.rescan(pid)
+		if s, ok := p.owners[inode]; ok && s.pid == pid {
+			p.found(pid)
+			return s, true, nil
+		}
+	}
+	// every process has been read, no one holds it
+	return socketFd{}, false, nil
+}
+
+// rebuild replaces the index with the sockets of pids.
+func (p *procIndex) rebuild(pids []int) {
+	p.owners = socketOwners(p.root, pids)
+	p.sockets = make(map[int][]uint32)
+	for inode, s := range p.owners {
+		p.sockets[s.pid] = append(p.sockets[s.pid], inode)
+	}
+	p.pids = make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		p.pids[pid] = true
+	}
+	for pid := range p.seen {
+		if _, ok := p.sockets[pid]; !ok {
+			delete(p.seen, pid)
+		}
+	}
+}
+
+// rescan reads the sockets of pid again.
+func (p *procIndex) rescan(pid int) {
+	fds, _ := pidSockets(p.root, pid)
+	p.setSockets(pid, fds)
+}
+
+func (p *procIndex) found(pid int) {
+	p.tick++
+	p.seen[pid] = p.tick
+}
+
+// setSockets replaces the inodes indexed for pid by fds, which maps inodes
+// to the fd holding them. Inodes another pid holds as well stay with it.
+func (p *procIndex) setSockets(pid int, fds map[uint32]string) {
+	for _, inode := range p.sockets[pid] {
+		if p.owners[inode].pid == pid {
+			delete(p.owners, inode)
+		}
+	}
+	delete(p.sockets, pid)
+	if len(fds) == 0 {
+		delete(p.seen, pid)
+	}
+	var kept []uint32
+	for inode, fd := range fds {
+		if _, ok := p.owners[inode]; !ok {
+			p.owners[inode] = socketFd{pid: pid, fd: fd}
+			kept = append(kept, inode)
+		}
+	}
+	if len(kept) > 0 {
+		p.sockets[pid] = kept
+	}
+}
+
+func (p *procIndex) add(inode uint32, owner socketFd, proc Process) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.cache[inode]; ok {
+		entry := e.Value.(*procEntry)
+		entry.owner, entry.proc = owner, proc
+		p.order.MoveToFront(e)
+		return
+	}
+	p.cache[inode] = p.order.PushFront(&procEntry{inode: inode, owner: owner, proc: proc})
+	if p.order.Len() > p.size {
+		last := p.order.Back()
+		p.order.Remove(last)
+		delete(p.cache, last.Value.(*procEntry).inode)
+	}
+}
+
+// listPids returns the pids under root.
+func listPids(root string) ([]int, error) {
+	proc, err := os.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	names, err := proc.Readdirnames(-1)
+	proc.Close()
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// socketOwners reads the fd symlinks of pids and returns the fd holding
+// each socket inode.
+func socketOwners(root string, pids []int) map[uint32]socketFd {
+	owners := make(map[uint32]socketFd)
+	for _, pid := range pids {
+		fds, _ := pidSockets(root, pid)
+		for inode, fd := range fds {
+			if _, ok := owners[inode]; !ok {
+				owners[inode] = socketFd{pid: pid, fd: fd}
+			}
+		}
+	}
+	return owners
+}
+
+// pidSockets returns the socket inodes pid has open and the fd holding
+// each.
+func pidSockets(root string, pid int) (map[uint32]string, error) {
+	fdDir := fmt.Sprintf("%s/%d/fd", root, pid)
+	dir, err := os.Open(fdDir)
+	if err != nil {
+		return nil, err
+	}
+	names, _ := dir.Readdirnames(-1)
+	dir.Close()
+	fds := make(map[uint32]string)
+	for _, fd := range names {
+		link, err := os.Readlink(fdDir + "/" + fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode, err := strconv.ParseUint(link[8:len(link)-1], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := fds[uint32(inode)]; !ok {
+			fds[uint32(inode)] = fd
+		}
+	}
+	return fds, nil
+}
+
+// readProcess collects what procfs knows about pid. Only a missing cmdline
+// is an error, anything else is left unknown.
+func readProcess(root string, pid int) (*Process, error) {
+	cmd, err := os.ReadFile(fmt.Sprintf("%s/%d/cmdline", root, pid))
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range cmd {
+		if c == 0 {
+			cmd[i] = 32
+		}
+	}
+	p := &Process{PID: pid, Cmdline: string(cmd), UID: -1, GID: -1, PPID: -1}
+	p.Path, p.Name = procExe(root, pid)
+
+	status, err := os.Open(fmt.Sprintf("%s/%d/status", root, pid))
+	if err == nil {
+		scanner := bufio.NewScanner(status)
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), ":")
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				continue
+			}
+			switch key {
+			case "Uid":
+				p.UID, _ = strconv.Atoi(fields[0])
+			case "Gid":
+				p.GID, _ = strconv.Atoi(fields[0])
+			case "PPid":
+				p.PPID, _ = strconv.Atoi(fields[0])
+			}
+		}
+		status.Close()
+	}
+	if p.PPID > 0 {
+		_, p.ParentName = procExe(root, p.PPID)
+	}
+
+	cgroup, err := os.ReadFile(fmt.Sprintf("%s/%d/cgroup", root, pid))
+	if err == nil {
+		p.Cgroup = parseCgroup(string(cgroup))
+	}
+	return p, nil
+}
+
+// procExe returns the executable path of pid and its name.
+func procExe(root string, pid int) (path, name string) {
+	path, err := os.Readlink(fmt.Sprintf("%s/%d/exe", root, pid))
+	if err == nil {
+		path = strings.TrimSuffix(path, " (deleted)")
+		return path, filepath.Base(path)
+	}
+	comm, err := os.ReadFile(fmt.Sprintf("%s/%d/comm", root, pid))
+	if err != nil {
+		return "", ""
+	}
+	return "", strings.TrimSpace(string(comm))
+}
+
+// parseCgroup picks the cgroup v2 path from /proc/<pid>/cgroup, or the
+// first v1 hierarchy's path.
+func parseCgroup(s string) string {
+	first := ""
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if first == "" {
+			first = parts[2]
+		}
+	}
+	return first
+}
@@ -0,0 +1,345 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeProc builds a procfs under a temporary directory.
+type fakeProc struct {
+	t    testing.TB
+	root string
+}
+
+func newFakeProc(t testing.TB) *fakeProc {
+	return &fakeProc{t: t, root: t.TempDir()}
+}
+
+func (f *fakeProc) write(name, data string) {
+	f.t.Helper()
+	name = filepath.Join(f.root, name)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// addProcess creates pid with the given command line and parent.
+func (f *fakeProc) addProcess(pid, ppid int, cmdline ...string) {
+	f.t.Helper()
+	f.write(fmt.Sprintf("%d/cmdline", pid), strings.Join(cmdline, "\x00")+"\x00")
+	f.write(fmt.Sprintf("%d/comm", pid), filepath.Base(cmdline[0])+"\n")
+	f.write(fmt.Sprintf("%d/status", pid), fmt.Sprintf("Name:\t%s\nPPid:\t%d\nUid:\t1000\t1000\t1000\t1000\nGid:\t100\t100\t100\t100\n", filepath.Base(cmdline[0]), ppid))
+	f.write(fmt.Sprintf("%d/cgroup", pid), "0::/user.slice/app.scope\n")
+	if err := os.MkdirAll(filepath.Join(f.root, fmt.Sprint(pid), "fd"), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// addSocket gives pid the socket inode as file descriptor fd.
+func (f *fakeProc) addSocket(pid, fd int, inode uint32) {
+	f.t.Helper()
+	link := filepath.Join(f.root, fmt.Sprint(pid), "fd", fmt.Sprint(fd))
+	if err := os.Symlink(fmt.Sprintf("socket:[%d]", inode), link); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeProc) removeProcess(pid int) {
+	f.t.Helper()
+	if err := os.RemoveAll(filepath.Join(f.root, fmt.Sprint(pid))); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+const (
+	benchProcs = 200
+	benchFds   = 20
+)
+
+func benchProc(b *testing.B) *fakeProc {
+	f := newFakeProc(b)
+	for pid := 1; pid <= benchProcs; pid++ {
+		f.addProcess(pid, 1, fmt.Sprintf("/usr/bin/app%d", pid))
+		for fd := 0; fd < benchFds; fd++ {
+			f.addSocket(pid, fd, uint32(pid*1000+fd))
+		}
+	}
+	return f
+}
+
+// lsOwner is how GetCmd used to find the owner of a socket: running ls on
+// the fd directory of every process.
+func lsOwner(root string, inode uint32) int {
+	names, _ := os.ReadDir(root)
+	goal := fmt.Sprintf("socket:[%d]", inode)
+	for _, name := range names {
+		pid, err := strconv.Atoi(name.Name())
+		if !name.IsDir() || err != nil {
+			continue
+		}
+		output, _ := exec.Command("ls", "-l", filepath.Join(root, name.Name(), "fd")).Output()
+		if strings.Contains(string(output), goal) {
+			return pid
+		}
+	}
+	return 0
+}
+
+func BenchmarkOwnerLs(b *testing.B) {
+	f := benchProc(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if lsOwner(f.root, benchProcs*1000) != benchProcs {
+			b.Fatal("owner not found")
+		}
+	}
+}
+
+// BenchmarkOwnerScan reads every fd symlink for each lookup.
+func BenchmarkOwnerScan(b *testing.B) {
+	f := benchProc(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pids, err := listPids(f.root)
+		if err != nil || socketOwners(f.root, pids)[benchProcs*1000].pid != benchProcs {
+			b.Fatal("owner not found")
+		}
+	}
+}
+
+// BenchmarkOwnerIndexNewSocket looks up a socket a known process just
+// opened, the common case of a new connection.
+func BenchmarkOwnerIndexNewSocket(b *testing.B) {
+	f := benchProc(b)
+	idx := newProcIndex(f.root, 1024)
+	if _, ok, _ := idx.owner(benchProcs * 1000); !ok {
+		b.Fatal("owner not found")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		inode := uint32(10000000 + i)
+		f.addSocket(benchProcs, benchFds+i, inode)
+		b.StartTimer()
+		if s, ok, _ := idx.owner(inode); !ok || s.pid != benchProcs {
+			b.Fatal("owner not found")
+		}
+	}
+}
+
+// BenchmarkOwnerIndexNewProcess looks up a socket of a process started
+// since the last lookup, which costs one scan.
+func BenchmarkOwnerIndexNewProcess(b *testing.B) {
+	f := benchProc(b)
+	idx := newProcIndex(f.root, 1024)
+	if _, ok, _ := idx.owner(benchProcs * 1000); !ok {
+		b.Fatal("owner not found")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		pid, inode := benchProcs+1+i, uint32(10000000+i)
+		f.addProcess(pid, 1, "/usr/bin/new")
+		f.addSocket(pid, 3, inode)
+		b.StartTimer()
+		if s, ok, _ := idx.owner(inode); !ok || s.pid != pid {
+			b.Fatal("owner not found")
+		}
+	}
+}
+
+// BenchmarkProcessCached looks up a socket whose process is cached.
+func BenchmarkProcessCached(b *testing.B) {
+	f := benchProc(b)
+	idx := newProcIndex(f.root, 1024)
+	idx.process(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if p, _ := idx.process(1000); p == nil {
+			b.Fatal("process not found")
+		}
+	}
+}
+
+// procFSFixture has curl (pid 100, child of bash 10) connected from
+// 127.0.0.1:50000 to 127.0.0.1:8080 over the socket inode 4242.
+func procFSFixture(t *testing.T) (*fakeProc, net.Addr, net.Addr) {
+	skipBigEndian(t)
+	f := newFakeProc(t)
+	f.addProcess(10, 1, "/bin/bash")
+	f.addSocket(10, 3, 9999)
+	f.addProcess(100, 10, "/usr/bin/curl", "-s", "example.com")
+	f.addSocket(100, 3, 4242)
+	f.write("net/tcp", procNetHeader+
+		procNetLine("0100007F:C350", "0100007F:1F90", "4242")+
+		procNetLine("0100007F:C351", "0100007F:1F90", "4243")+
+		procNetLine("0100007F:C352", "0100007F:1F90", "4244"))
+	f.write("net/tcp6", procNetHeader)
+	app := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	us := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	return f, app, us
+}
+
+func TestProcFSLookup(t *testing.T) {
+	f, app, us := procFSFixture(t)
+	fs := NewProcFS(f.root)
+	p, err := fs.Lookup("tcp", app, us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Process{
+		PID:        100,
+		Cmdline:    "/usr/bin/curl -s example.com ",
+		Name:       "curl",
+		UID:        1000,
+		GID:        100,
+		Cgroup:     "/user.slice/app.scope",
+		PPID:       10,
+		ParentName: "bash",
+	}
+	if p == nil || *p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+}
+
+func TestProcFSMissingSocket(t *testing.T) {
+	f, app, us := procFSFixture(t)
+	fs := NewProcFS(f.root)
+	// not in net/tcp
+	p, err := fs.Lookup("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50009}, us)
+	if p != nil || err != nil {
+		t.Errorf("unknown socket: got %+v, %v", p, err)
+	}
+	// in net/tcp but held by no process
+	p, err = fs.Lookup("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}, us)
+	if p != nil || err != nil {
+		t.Errorf("orphan socket: got %+v, %v", p, err)
+	}
+	if p, _ = fs.Lookup("tcp", app, us); p == nil {
+		t.Error("known socket not found")
+	}
+}
+
+func TestProcFSNewSockets(t *testing.T) {
+	f, app, us := procFSFixture(t)
+	fs := NewProcFS(f.root)
+	if p, _ := fs.Lookup("tcp", app, us); p == nil {
+		t.Fatal("known socket not found")
+	}
+	// a new socket of a process already indexed
+	f.addSocket(100, 4, 4243)
+	p, err := fs.Lookup("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}, us)
+	if err != nil || p == nil || p.PID != 100 {
+		t.Errorf("new socket of known process: got %+v, %v", p, err)
+	}
+	// a socket of a process started since the index was built
+	f.addProcess(200, 1, "/usr/bin/wget")
+	f.addSocket(200, 3, 4244)
+	p, err = fs.Lookup("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50002}, us)
+	if err != nil || p == nil || p.PID != 200 {
+		t.Errorf("socket of new process: got %+v, %v", p, err)
+	}
+}
+
+func TestProcFSProcessExits(t *testing.T) {
+	f, _, us := procFSFixture(t)
+	f.addSocket(100, 4, 4243)
+	fs := NewProcFS(f.root)
+	// index curl through its first socket only
+	if _, ok, _ := fs.index.owner(4242); !ok {
+		t.Fatal("socket not indexed")
+	}
+
+	// curl exits after its socket was indexed but before it was read
+	f.removeProcess(100)
+	p, err := fs.Lookup("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}, us)
+	if p != nil || err != nil {
+		t.Errorf("exited process: got %+v, %v", p, err)
+	}
+	fs.index.indexMu.Lock()
+	_, indexed := fs.index.owners[4243]
+	fs.index.indexMu.Unlock()
+	if indexed {
+		t.Error("sockets of the exited process are still indexed")
+	}
+
+	// the fd is still there but the rest of /proc/<pid> is gone
+	f.addProcess(300, 1, "/usr/bin/ssh")
+	f.addSocket(300, 3, 4244)
+	if err := os.Remove(filepath.Join(f.root, "300", "cmdline")); err != nil {
+		t.Fatal(err)
+	}
+	p, err = fs.Lookup("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50002}, us)
+	if p != nil || err != nil {
+		t.Errorf("half-gone process: got %+v, %v", p, err)
+	}
+}
+
+func TestProcFSReusedInode(t *testing.T) {
+	f, app, us := procFSFixture(t)
+	fs := NewProcFS(f.root)
+	if p, _ := fs.Lookup("tcp", app, us); p == nil || p.PID != 100 {
+		t.Fatalf("got %+v", p)
+	}
+
+	// curl exits and its inode is handed to a new process
+	f.removeProcess(100)
+	f.addProcess(400, 1, "/usr/bin/nc")
+	f.addSocket(400, 5, 4242)
+	p, err := fs.Lookup("tcp", app, us)
+	if err != nil || p == nil || p.PID != 400 {
+		t.Errorf("after reuse by a new process: got %+v, %v", p, err)
+	}
+
+	// nc closes it and bash, which is still running, gets the inode
+	if err := os.Remove(filepath.Join(f.root, "400", "fd", "5")); err != nil {
+		t.Fatal(err)
+	}
+	f.addSocket(10, 7, 4242)
+	p, err = fs.Lookup("tcp", app, us)
+	if err != nil || p == nil || p.PID != 10 {
+		t.Errorf("after reuse by a known process: got %+v, %v", p, err)
+	}
+}
+
+func TestProcIndexStale(t *testing.T) {
+	f, _, _ := procFSFixture(t)
+	idx := newProcIndex(f.root, 16)
+	if _, ok, _ := idx.owner(4242); !ok {
+		t.Fatal("socket not indexed")
+	}
+
+	// a process started since: the index is rebuilt straight away, even
+	// though a known process holds the socket
+	f.addProcess(500, 1, "/usr/bin/new")
+	f.addSocket(100, 4, 5000)
+	s, ok, err := idx.owner(5000)
+	if err != nil || !ok || s != (socketFd{pid: 100, fd: "4"}) {
+		t.Fatalf("got %+v %v %v", s, ok, err)
+	}
+	if !idx.pids[500] {
+		t.Error("index not rebuilt")
+	}
+
+	// nothing started since, only known processes are read
+	f.addSocket(500, 3, 6000)
+	if s, ok, _ := idx.owner(6000); !ok || s.pid != 500 {
+		t.Errorf("socket of known process: got %+v %v", s, ok)
+	}
+	f.removeProcess(500)
+	if _, ok, _ := idx.owner(7000); ok || idx.pids[500] {
+		t.Errorf("exited process still indexed: %v", idx.pids)
+	}
+	if _, ok := idx.owners[6000]; ok {
+		t.Error("socket of exited process still indexed")
+	}
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+var nativeEndian binary.ByteOrder = binary.BigEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	}
+}
+
+// hostPort splits a *net.TCPAddr or *net.UDPAddr.
+func hostPort(addr net.Addr) (net.IP, int, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, nil
+	case *net.UDPAddr:
+		return a.IP, a.Port, nil
+	}
+	return nil, 0, errors.New("unsupported address type " + addr.Network())
+}
+
+// procNetInode finds the inode of the socket local -> remote in the
+// net/tcp, net/tcp6, net/udp or net/udp6 tables under root. IPv4
+// addresses also match their IPv4-mapped form in the IPv6 tables. A UDP
+// socket that is not connected lists no remote address, so failing an
+// exact match it is matched by its local port and address or wildcard.
+func procNetInode(root, network string, local, remote net.Addr) (uint32, error) {
+	if network != "tcp" && network != "udp" {
+		return 0, errors.New("unsupported network " + network)
+	}
+	lip, lport, err := hostPort(local)
+	if err != nil {
+		return 0, err
+	}
+	rip, rport, err := hostPort(remote)
+	if err != nil {
+		return 0, err
+	}
+
+	tables := []string{network, network + "6"}
+	if lip.To4() == nil {
+		tables = tables[1:]
+	}
+	var firstErr error
+	for _, table := range tables {
+		f, err := os.Open(root + "/net/" + table)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		inode, err := scanProcNet(f, network == "udp", lip, lport, rip, rport)
+		f.Close()
+		if err != nil || inode != 0 {
+			return inode, err
+		}
+	}
+	if len(tables) == 2 && firstErr != nil {
+		return 0, firstErr
+	}
+	return 0, nil
+}
+
+func scanProcNet(f *os.File, udp bool, lip net.IP, lport int, rip net.IP, rport int) (uint32, error) {
+	var unconnected uint32
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // ignore title
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		ip, port, err := parseProcAddr(fields[1])
+		if err != nil || port != lport || !(ip.Equal(lip) || udp && ip.IsUnspecified()) {
+			continue
+		}
+		localAny := ip.IsUnspecified()
+		ip, port, err = parseProcAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		if port == rport && ip.Equal(rip) && !localAny {
+			return uint32(inode), nil
+		}
+		if udp && port == 0 && ip.IsUnspecified() && unconnected == 0 {
+			unconnected = uint32(inode)
+		}
+	}
+	return unconnected, scanner.Err()
+}
+
+// parseProcAddr decodes an "ADDR:PORT" field of /proc/net/{tcp,udp}{,6}.
+// The address is printed as 32-bit words in host byte order.
+func parseProcAddr(s string) (net.IP, int, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, 0, errors.New("invalid address " + s)
+	}
+	b, err := hex.DecodeString(s[:i])
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return nil, 0, errors.New("invalid address " + s)
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, 0, errors.New("invalid port " + s)
+	}
+	ip := make(net.IP, len(b))
+	for j := 0; j < len(b); j += 4 {
+		binary.BigEndian.PutUint32(ip[j:j+4], nativeEndian.Uint32(b[j:j+4]))
+	}
+	return ip, int(port), nil
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+const procNetHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// procNetLine formats a /proc/net table row for the socket local -> remote.
+func procNetLine(local, remote, inode string) string {
+	return "   0: " + local + " " + remote + " 01 00000000:00000000 00:00000000 00000000  1000        0 " + inode + " 1 0000000000000000 20 4 30 10 -1\n"
+}
+
+func skipBigEndian(t *testing.T) {
+	if nativeEndian == binary.BigEndian {
+		t.Skip("fixtures are in little-endian order")
+	}
+}
+
+func TestParseProcAddr(t *testing.T) {
+	skipBigEndian(t)
+	tests := []struct {
+		in   string
+		ip   string
+		port int
+	}{
+		{"0100007F:1F90", "127.0.0.1", 8080},
+		{"0101A8C0:0035", "192.168.1.1", 53},
+		{"00000000:0000", "0.0.0.0", 0},
+		{"B80D0120000000000000000001000000:0050", "2001:db8::1", 80},
+		{"00000000000000000000000001000000:01BB", "::1", 443},
+		{"0000000000000000FFFF00000100007F:C350", "127.0.0.1", 50000},
+	}
+	for _, tt := range tests {
+		ip, port, err := parseProcAddr(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tt.ip)) || port != tt.port {
+			t.Errorf("%s: got %s:%d, want %s:%d", tt.in, ip, port, tt.ip, tt.port)
+		}
+	}
+	for _, bad := range []string{"0100007F", "0100007:1F90", "zz00007F:1F90", "0100007F:GGGG"} {
+		if _, _, err := parseProcAddr(bad); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+func TestProcNetInode(t *testing.T) {
+	skipBigEndian(t)
+	f := newFakeProc(t)
+	f.write("net/tcp", procNetHeader+
+		procNetLine("0100007F:C350", "0100007F:1F90", "1001")+
+		procNetLine("00000000:1F90", "00000000:0000", "1002"))
+	f.write("net/tcp6", procNetHeader+
+		// a dual-stack socket of an IPv4 client
+		procNetLine("0000000000000000FFFF00000100007F:C351", "0000000000000000FFFF00000100007F:1F90", "1003")+
+		procNetLine("00000000000000000000000001000000:C352", "00000000000000000000000001000000:1F90", "1004"))
+	f.write("net/udp", procNetHeader+
+		procNetLine("0100007F:D000", "0100007F:0035", "2001")+
+		procNetLine("00000000:D001", "00000000:0000", "2002"))
+	f.write("net/udp6", procNetHeader+
+		procNetLine("00000000000000000000000001000000:D002", "00000000000000000000000001000000:0035", "2003")+
+		procNetLine("00000000000000000000000000000000:D003", "00000000000000000000000000000000:0000", "2004"))
+
+	tcp := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	udp := func(ip string, port int) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: port} }
+	tests := []struct {
+		name    string
+		network string
+		app, us net.Addr
+		inode   uint32
+	}{
+		{"tcp", "tcp", tcp("127.0.0.1", 50000), tcp("127.0.0.1", 8080), 1001},
+		{"tcp ipv4-mapped", "tcp", tcp("127.0.0.1", 50001), tcp("127.0.0.1", 8080), 1003},
+		{"tcp6", "tcp", tcp("::1", 50002), tcp("::1", 8080), 1004},
+		{"tcp missing", "tcp", tcp("127.0.0.1", 50009), tcp("127.0.0.1", 8080), 0},
+		{"tcp listener is not a peer", "tcp", tcp("127.0.0.1", 8080), tcp("127.0.0.1", 50000), 0},
+		{"udp connected", "udp", udp("127.0.0.1", 0xd000), udp("127.0.0.1", 53), 2001},
+		{"udp unconnected", "udp", udp("127.0.0.1", 0xd001), udp("127.0.0.1", 53), 2002},
+		{"udp6 connected", "udp", udp("::1", 0xd002), udp("::1", 53), 2003},
+		{"udp6 unconnected", "udp", udp("::1", 0xd003), udp("::1", 53), 2004},
+		{"udp missing", "udp", udp("127.0.0.1", 0xd009), udp("127.0.0.1", 53), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inode, err := procNetInode(f.root, tt.network, tt.app, tt.us)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inode != tt.inode {
+				t.Errorf("inode %d, want %d", inode, tt.inode)
+			}
+		})
+	}
+}
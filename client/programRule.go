@@ -3,15 +3,31 @@ package client
 import (
 	"bufio"
 	"errors"
-	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// Program rule conditions, written as KIND,value in programRule.db. Any
+// other word is a keyword matched against the command line.
+const (
+	condProcessName = "PROCESS-NAME"
+	condProcessPath = "PROCESS-PATH"
+	condUID         = "UID"
+	condGID         = "GID"
+	condCgroup      = "CGROUP"
+	condParentName  = "PARENT-NAME"
+)
+
+type procCond struct {
+	// the condition as written in the rule file
+	rule  string
+	kind  string
+	value string
+}
+
 func (r *Rules) ParseProgramRules(name string) error {
 	f, err := os.Open(name)
 	if err != nil {
@@ -20,6 +36,7 @@ func (r *Rules) ParseProgramRules(name string) error {
 	defer f.Close()
 
 	r.program = make(map[string]bool)
+	r.procConds = nil
 	scanner := bufio.NewScanner(f)
 	scanner.Split(bufio.ScanWords)
 
@@ -34,115 +51,146 @@ func (r *Rules) ParseProgramRules(name string) error {
 	}
 
 	for scanner.Scan() {
-		word := scanner.Text()
-		r.program[word] = true
+		word, profile := splitOutbound(scanner.Text())
+		cond, ok, err := parseProcCond(word)
+		if err != nil {
+			return err
+		}
+		if ok {
+			r.procConds = append(r.procConds, cond)
+		} else {
+			r.program[word] = true
+		}
+		r.setOutbound(ruleProgram, word, profile)
 	}
 	return nil
 }
 
-func (r *Rules) MatchCmd(conn net.Conn) (bool, string, error) {
-	if !r.progON || len(r.program) == 0 {
+func parseProcCond(word string) (cond procCond, ok bool, err error) {
+	kind, value, found := strings.Cut(word, ",")
+	if !found {
+		return
+	}
+	switch kind {
+	case condProcessName, condProcessPath, condCgroup, condParentName:
+	case condUID, condGID:
+		if _, err = strconv.ParseUint(value, 10, 32); err != nil {
+			return cond, false, errors.New("invalid id in " + word)
+		}
+	default:
+		return
+	}
+	if value == "" {
+		return cond, false, errors.New("empty value in " + word)
+	}
+	return procCond{rule: word, kind: kind, value: value}, true, nil
+}
+
+func (r *Rules) programEnabled() bool {
+	return r.progON && (len(r.program) > 0 || len(r.procConds) > 0)
+}
+
+// MatchCmd looks up the process behind conn with resolver and matches it
+// against the program rules.
+func (r *Rules) MatchCmd(conn net.Conn, resolver ProcessResolver) (bool, string, error) {
+	if !r.programEnabled() {
 		return false, "", nil
 	}
-	cmd, err := GetCmd(conn)
+	p, err := resolver.Lookup(conn.LocalAddr().Network(), conn.RemoteAddr(), conn.LocalAddr())
 	if err != nil {
 		return false, "", err
 	}
+	if p == nil {
+		return false, "", nil
+	}
+	isMatch, key := r.MatchProcess(p)
+	return isMatch, key, nil
+}
+
+// MatchProgram matches the command line of a process against the program
+// keywords.
+func (r *Rules) MatchProgram(cmd string) (bool, string) {
+	if !r.progON {
+		return false, ""
+	}
 	for key := range r.program {
 		if strings.Contains(cmd, key) {
-			return true, key, nil
+			return true, key
 		}
 	}
-	return false, "", nil
+	return false, ""
 }
 
-func ipToHex(ip string) string {
-	host, port, _ := net.SplitHostPort(ip)
-	var split [4]int
-	j := 0
-	for i := 0; i < len(host); i++ {
-		if host[i] == '.' {
-			j++
-			continue
-		}
-		split[j] = split[j]*10 + int(host[i]-'0')
+// MatchProcess matches p against the program keywords and then the
+// conditions in the order of the rule file. The matching rule is returned
+// as written in the rule file.
+func (r *Rules) MatchProcess(p *Process) (bool, string) {
+	if isMatch, key := r.MatchProgram(p.Cmdline); isMatch {
+		return true, key
 	}
-	var splitStr [4]string
-	for i := 0; i < 4; i++ {
-		splitStr[i] = fill0(fmt.Sprintf("%X", split[3-i]), 2)
+	if !r.progON {
+		return false, ""
 	}
-	portInt, _ := strconv.Atoi(port)
-	port = fill0(fmt.Sprintf("%X", portInt), 4)
-	return fmt.Sprintf("%s%s%s%s:%s", splitStr[0], splitStr[1], splitStr[2], splitStr[3], port)
-}
-
-func fill0(s string, digit int) string {
-	for len(s) < digit {
-		s = "0" + s
+	for _, cond := range r.procConds {
+		if cond.match(p) {
+			return true, cond.rule
+		}
 	}
-	return s
+	return false, ""
 }
 
-func isNumber(s string) bool {
-	_, err := strconv.ParseUint(s, 10, 32)
-	return err == nil
+func (c procCond) match(p *Process) bool {
+	switch c.kind {
+	case condProcessName:
+		return p.Name != "" && p.Name == c.value
+	case condProcessPath:
+		return p.Path != "" && p.Path == filepath.Clean(c.value)
+	case condUID:
+		return p.UID >= 0 && strconv.Itoa(p.UID) == c.value
+	case condGID:
+		return p.GID >= 0 && strconv.Itoa(p.GID) == c.value
+	case condCgroup:
+		return p.Cgroup != "" && cgroupContains(p.Cgroup, c.value)
+	case condParentName:
+		return p.ParentName != "" && p.ParentName == c.value
+	}
+	return false
 }
 
-func GetCmd(conn net.Conn) (ret string, err error) {
-	local := ipToHex(conn.RemoteAddr().String())
-	remote := ipToHex(conn.LocalAddr().String())
-
-	tcpFile, err := os.Open("/proc/net/tcp")
-	if err != nil {
-		return
+// cgroupContains reports whether the cgroup path is, or is inside, a
+// cgroup named by value: either an absolute path or a single unit name
+// such as docker.service.
+func cgroupContains(cgroup, value string) bool {
+	if strings.HasPrefix(value, "/") {
+		value = strings.TrimSuffix(value, "/")
+		return cgroup == value || strings.HasPrefix(cgroup, value+"/")
 	}
-	defer tcpFile.Close()
-	scanner := bufio.NewScanner(tcpFile)
-	var inode string
-	scanner.Scan() // ignore title
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		localAddr := fields[1]
-		remoteAddr := fields[2]
-		if localAddr == local && remoteAddr == remote {
-			inode = fields[9]
-			break
+	for _, part := range strings.Split(cgroup, "/") {
+		if part == value {
+			return true
 		}
 	}
-	if inode == "" {
-		return
-	}
-	goal := "socket:[" + inode + "]"
+	return false
+}
 
-	proc, err := os.Open("/proc")
-	if err != nil {
-		return
-	}
-	defer proc.Close()
-	fileinfos, err := proc.Readdir(-1)
-	if err != nil {
-		return
+// GetCmd returns the command line of the local process owning the other end
+// of conn, or "" if it cannot be found.
+func GetCmd(conn net.Conn) (string, error) {
+	p, err := LookupProcess(conn)
+	if p == nil {
+		return "", err
 	}
+	return p.Cmdline, err
+}
 
-	for _, fileinfo := range fileinfos {
-		if !(fileinfo.IsDir() && isNumber(fileinfo.Name())) {
-			continue
-		}
-		pid := fileinfo.Name()
-		cmd := exec.Command("ls", "-l", fmt.Sprintf("/proc/%s/fd", pid))
-		output, _ := cmd.Output()
-
-		if strings.Contains(string(output), goal) {
-			cmd, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%s/cmdline", pid))
-			for i, c := range cmd {
-				if c == 0 {
-					cmd[i] = 32
-				}
-			}
-			ret = string(cmd)
-			return
-		}
-	}
-	return
+// LookupProcess returns the local process owning the other end of conn, or
+// nil if it cannot be found.
+func LookupProcess(conn net.Conn) (*Process, error) {
+	return LookupProcessByAddr(conn.LocalAddr().Network(), conn.RemoteAddr(), conn.LocalAddr())
+}
+
+// LookupProcessByAddr returns the local process owning the "tcp" or "udp"
+// socket app -> us, or nil if it cannot be found.
+func LookupProcessByAddr(network string, app, us net.Addr) (*Process, error) {
+	return DefaultResolver.Lookup(network, app, us)
 }
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchProcessOrder(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "programRule.db")
+	data := "ON\nUID,1000 CGROUP,app.scope PROCESS-NAME,curl GID,100 PARENT-NAME,bash\n"
+	if err := os.WriteFile(rules, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &Process{Name: "curl", UID: 1000, GID: 100, Cgroup: "/user.slice/app.scope", ParentName: "bash"}
+	for i := 0; i < 20; i++ {
+		var r Rules
+		if err := r.ParseProgramRules(rules); err != nil {
+			t.Fatal(err)
+		}
+		if match, key := r.MatchProcess(p); !match || key != "UID,1000" {
+			t.Fatalf("got %v %q, want the first condition", match, key)
+		}
+		// the first that matches
+		p2 := *p
+		p2.UID = 0
+		if match, key := r.MatchProcess(&p2); !match || key != "CGROUP,app.scope" {
+			t.Fatalf("got %v %q, want the second condition", match, key)
+		}
+	}
+}
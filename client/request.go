@@ -0,0 +1,85 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"proxy/base"
+)
+
+// request is one connection accepted from a local application, waiting to
+// be routed.
+type request struct {
+	conn    net.Conn
+	fe      frontend
+	replied bool
+	atyp    int
+	addr    string
+	port    uint16
+	// data already read from the application, to be sent first
+	tosend []byte
+}
+
+// frontend is the protocol spoken with the local application.
+type frontend interface {
+	// ready tells the application its tunnel is up. bnd is nil when the
+	// outbound connection has not been made yet.
+	ready(conn net.Conn, bnd net.Addr) error
+	fail(conn net.Conn, err error)
+}
+
+func (r *request) destAddr() string {
+	addr := r.addr
+	if r.atyp == 4 {
+		addr = "[" + addr + "]"
+	}
+	return fmt.Sprintf("%s:%d", addr, r.port)
+}
+
+func (r *request) ready(bnd net.Addr) error {
+	if r.replied {
+		return nil
+	}
+	r.replied = true
+	return r.fe.ready(r.conn, bnd)
+}
+
+// fail reports err to the application if it has not been answered yet and
+// closes the connection.
+func (r *request) fail(err error) {
+	if !r.replied {
+		r.replied = true
+		r.fe.fail(r.conn, err)
+	}
+	r.conn.Close()
+}
+
+type socksFrontend struct{}
+
+func (socksFrontend) ready(conn net.Conn, bnd net.Addr) error {
+	tcpAddr, ok := bnd.(*net.TCPAddr)
+	if !ok {
+		// placeholder, the real address is not known yet
+		return base.WriteResponse(conn, net.ParseIP("1.2.3.4"), 8080)
+	}
+	return base.WriteResponse(conn, tcpAddr.IP, uint16(tcpAddr.Port))
+}
+
+func (socksFrontend) fail(conn net.Conn, err error) {
+	conn.Write([]byte{5, base.ReplyCode(err)})
+}
+
+// bufConn lets a protocol be sniffed with Peek before the connection is
+// handed on.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufConn(conn net.Conn) *bufConn {
+	return &bufConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
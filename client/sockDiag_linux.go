@@ -0,0 +1,114 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	netlinkSockDiag  = 4
+	sockDiagByFamily = 20
+	inetDiagReqLen   = 56
+	inetDiagMsgLen   = 72
+)
+
+// sockDiag asks the kernel through NETLINK_SOCK_DIAG for the "tcp" or
+// "udp" socket local -> remote and returns its inode and owner UID. An
+// IPv4 pair is also looked up as IPv4-mapped in case the owner has a
+// dual-stack IPv6 socket.
+func sockDiag(network string, local, remote net.Addr) (inode, uid uint32, err error) {
+	var proto uint8
+	switch network {
+	case "tcp":
+		proto = syscall.IPPROTO_TCP
+	case "udp":
+		proto = syscall.IPPROTO_UDP
+	default:
+		return 0, 0, errors.New("sock_diag: unsupported network " + network)
+	}
+	lip, lport, err := hostPort(local)
+	if err != nil {
+		return
+	}
+	rip, rport, err := hostPort(remote)
+	if err != nil {
+		return
+	}
+
+	if proto == syscall.IPPROTO_UDP {
+		// the kernel looks UDP sockets up as the receiver of src -> dst
+		lip, lport, rip, rport = rip, rport, lip, lport
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkSockDiag)
+	if err != nil {
+		return
+	}
+	defer syscall.Close(fd)
+
+	if lip.To4() != nil && rip.To4() != nil {
+		inode, uid, err = sockDiagQuery(fd, syscall.AF_INET, proto, lip.To4(), lport, rip.To4(), rport)
+		if err != nil || inode != 0 {
+			return
+		}
+	}
+	return sockDiagQuery(fd, syscall.AF_INET6, proto, lip.To16(), lport, rip.To16(), rport)
+}
+
+func sockDiagQuery(fd int, family, proto uint8, lip net.IP, lport int, rip net.IP, rport int) (inode, uid uint32, err error) {
+	msg := make([]byte, syscall.NLMSG_HDRLEN+inetDiagReqLen)
+	nativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:6], sockDiagByFamily)
+	nativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST)
+	nativeEndian.PutUint32(msg[8:12], 1)
+	req := msg[syscall.NLMSG_HDRLEN:]
+	req[0] = family
+	req[1] = proto
+	nativeEndian.PutUint32(req[4:8], 0xffffffff) // all states
+	// inet_diag_sockid, ports and addresses in network byte order
+	binary.BigEndian.PutUint16(req[8:10], uint16(lport))
+	binary.BigEndian.PutUint16(req[10:12], uint16(rport))
+	copy(req[12:28], lip)
+	copy(req[28:44], rip)
+	// no cookie
+	nativeEndian.PutUint32(req[48:52], 0xffffffff)
+	nativeEndian.PutUint32(req[52:56], 0xffffffff)
+
+	err = syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 4096)
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case syscall.NLMSG_ERROR:
+			if len(m.Data) >= 4 {
+				if errno := int32(nativeEndian.Uint32(m.Data[:4])); errno != 0 {
+					if syscall.Errno(-errno) == syscall.ENOENT {
+						// no such socket
+						return 0, 0, nil
+					}
+					return 0, 0, syscall.Errno(-errno)
+				}
+			}
+		case sockDiagByFamily:
+			if len(m.Data) < inetDiagMsgLen {
+				return 0, 0, errors.New("sock_diag: short message")
+			}
+			uid = nativeEndian.Uint32(m.Data[64:68])
+			inode = nativeEndian.Uint32(m.Data[68:72])
+			return
+		}
+	}
+	return 0, 0, errors.New("sock_diag: no answer")
+}
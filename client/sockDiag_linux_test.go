@@ -0,0 +1,80 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+// socketInode returns the inode of the socket behind conn.
+func socketInode(t *testing.T, conn interface {
+	File() (*os.File, error)
+}) uint32 {
+	t.Helper()
+	f, err := conn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	link, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	if err != nil {
+		t.Skip("no /proc:", err)
+	}
+	var inode uint32
+	if _, err = fmt.Sscanf(link, "socket:[%d]", &inode); err != nil {
+		t.Fatal(link, err)
+	}
+	return inode
+}
+
+// The kernel looks a UDP socket up as the receiver of a datagram, so
+// sockDiag swaps the ends it is given.
+func TestSockDiagUDP(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	app, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	want := socketInode(t, app)
+
+	inode, _, err := sockDiag("udp", app.LocalAddr(), server.LocalAddr())
+	if err != nil {
+		t.Skip("sock_diag unavailable:", err)
+	}
+	if inode != want {
+		t.Errorf("inode %d, want %d", inode, want)
+	}
+}
+
+func TestSockDiagTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	app, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	us, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+	want := socketInode(t, app.(*net.TCPConn))
+
+	inode, uid, err := sockDiag("tcp", app.LocalAddr(), us.LocalAddr())
+	if err != nil {
+		t.Skip("sock_diag unavailable:", err)
+	}
+	if inode != want || int(uid) != os.Getuid() {
+		t.Errorf("inode %d uid %d, want %d and %d", inode, uid, want, os.Getuid())
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+func sockDiag(network string, local, remote net.Addr) (inode, uid uint32, err error) {
+	return 0, 0, errors.New("sock_diag is only available on Linux")
+}
@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cache keeps upstream responses until their TTL runs out, evicting the
+// least recently used entry when full. Cached responses are served with
+// their TTLs counted down.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	// bounds applied to the TTL a response is kept for
+	MinTTL uint32
+	MaxTTL uint32
+	// NegativeTTL is used for NXDOMAIN and empty answers without an SOA.
+	NegativeTTL uint32
+}
+
+type cacheEntry struct {
+	key     string
+	msg     []byte
+	ttlOffs []int
+	ttls    []uint32
+	stored  time.Time
+	expire  time.Time
+}
+
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:        size,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element),
+		MaxTTL:      86400,
+		NegativeTTL: 30,
+	}
+}
+
+func cacheKey(q Question) string {
+	return fmt.Sprintf("%s/%d/%d", CanonicalName(q.Name), q.Type, q.Class)
+}
+
+// Get returns a copy of the cached response to q with its ID set to id, or
+// nil if there is none.
+func (c *Cache) Get(q Question, id uint16) []byte {
+	key := cacheKey(q)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	if !now.Before(entry.expire) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(e)
+
+	msg := make([]byte, len(entry.msg))
+	copy(msg, entry.msg)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for i, off := range entry.ttlOffs {
+		ttl := uint32(0)
+		if entry.ttls[i] > elapsed {
+			ttl = entry.ttls[i] - elapsed
+		}
+		binary.BigEndian.PutUint32(msg[off:off+4], ttl)
+	}
+	return msg
+}
+
+// Put stores resp, the response to q parsed as m, if it is cacheable.
+func (c *Cache) Put(q Question, resp []byte, m *Message) {
+	if m.Truncated() || (m.Rcode() != RcodeSuccess && m.Rcode() != RcodeNameError) {
+		return
+	}
+	entry := &cacheEntry{key: cacheKey(q), stored: time.Now()}
+	ttl, found := uint32(0), false
+	for _, rr := range append(m.Answers, m.Authority...) {
+		entry.ttlOffs = append(entry.ttlOffs, rr.ttlOff)
+		entry.ttls = append(entry.ttls, rr.TTL)
+	}
+	for _, rr := range m.Answers {
+		if !found || rr.TTL < ttl {
+			ttl, found = rr.TTL, true
+		}
+	}
+	if !found {
+		// negative answer, kept for the smaller of the SOA's TTL and
+		// MINIMUM (RFC 2308)
+		ttl = c.NegativeTTL
+		for _, rr := range m.Authority {
+			if rr.Type == TypeSOA {
+				ttl = rr.TTL
+				if min, ok := soaMinimum(resp, rr); ok && min < ttl {
+					ttl = min
+				}
+			}
+		}
+	}
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	if ttl == 0 {
+		return
+	}
+	entry.expire = entry.stored.Add(time.Duration(ttl) * time.Second)
+	entry.msg = make([]byte, len(resp))
+	copy(entry.msg, resp)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[entry.key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).key)
+	}
+}
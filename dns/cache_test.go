@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// negativeReply builds an NXDOMAIN for missing.example.com whose SOA has
+// the given TTL and MINIMUM, with its names compressed.
+func negativeReply(t *testing.T, ttl, minimum uint32) ([]byte, *Message) {
+	t.Helper()
+	b := header(1, flagQR|RcodeNameError, 1, 0, 1, 0)
+	b, _ = appendName(b, "missing.example.com")
+	b = append(b, 0, TypeA, 0, ClassINET)
+	// example.com is at 12+8
+	rdata := []byte{2, 'n', 's', 0xc0, 20, 5, 'a', 'd', 'm', 'i', 'n', 0xc0, 20}
+	for _, v := range []uint32{2024010101, 7200, 3600, 1209600, minimum} {
+		rdata = appendUint32(rdata, v)
+	}
+	b = append(b, 0xc0, 20)
+	b = appendUint16(b, TypeSOA)
+	b = appendUint16(b, ClassINET)
+	b = appendUint32(b, ttl)
+	b = appendUint16(b, uint16(len(rdata)))
+	b = append(b, rdata...)
+	m, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, m
+}
+
+// cachedFor returns how long the cache keeps the answer to q, 0 if it
+// does not.
+func cachedFor(c *Cache, q Question) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey(q)]
+	if !ok {
+		return 0
+	}
+	entry := e.Value.(*cacheEntry)
+	return entry.expire.Sub(entry.stored)
+}
+
+func TestCacheNegative(t *testing.T) {
+	tests := []struct {
+		ttl, minimum uint32
+		want         time.Duration
+	}{
+		{300, 60, time.Minute},
+		{30, 3600, 30 * time.Second},
+		{0, 60, 0},
+	}
+	for _, tt := range tests {
+		c := NewCache(16)
+		resp, m := negativeReply(t, tt.ttl, tt.minimum)
+		if min, ok := soaMinimum(resp, m.Authority[0]); !ok || min != tt.minimum {
+			t.Errorf("MINIMUM %d %v, want %d", min, ok, tt.minimum)
+		}
+		q, _ := m.Question()
+		c.Put(q, resp, m)
+		if got := cachedFor(c, q); got != tt.want {
+			t.Errorf("SOA TTL %d MINIMUM %d: cached for %v, want %v", tt.ttl, tt.minimum, got, tt.want)
+		}
+	}
+
+	// without an SOA, NegativeTTL
+	c := NewCache(16)
+	query, _ := Parse(query(t, 1, "missing.test", TypeA))
+	resp, _ := Reply(query, RcodeNameError)
+	m, _ := Parse(resp)
+	c.Put(query.Questions[0], resp, m)
+	if got := cachedFor(c, query.Questions[0]); got != 30*time.Second {
+		t.Errorf("without SOA: cached for %v", got)
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	c := NewCache(16)
+	c.MinTTL, c.MaxTTL = 10, 100
+	query, _ := Parse(query(t, 1, "example.com", TypeA))
+	q := query.Questions[0]
+	resp, _ := AnswerReply(query, RcodeSuccess, []RR{
+		{Name: q.Name, Type: TypeA, Class: ClassINET, TTL: 5, Data: []byte{192, 0, 2, 1}},
+		{Name: q.Name, Type: TypeA, Class: ClassINET, TTL: 500, Data: []byte{192, 0, 2, 2}},
+	})
+	m, _ := Parse(resp)
+	c.Put(q, resp, m)
+	// the smallest TTL raised to MinTTL
+	if got := cachedFor(c, q); got != 10*time.Second {
+		t.Errorf("cached for %v", got)
+	}
+
+	// pretend it was stored 3 seconds ago
+	c.mu.Lock()
+	entry := c.entries[cacheKey(q)].Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-3 * time.Second)
+	c.mu.Unlock()
+	got := c.Get(Question{Name: "EXAMPLE.com", Type: TypeA, Class: ClassINET}, 42)
+	if got == nil {
+		t.Fatal("not cached")
+	}
+	if id := binary.BigEndian.Uint16(got); id != 42 {
+		t.Errorf("id %d", id)
+	}
+	gm, _ := Parse(got)
+	if gm.Answers[0].TTL != 2 || gm.Answers[1].TTL != 497 {
+		t.Errorf("TTLs %d %d", gm.Answers[0].TTL, gm.Answers[1].TTL)
+	}
+	if c.Get(Question{Name: "example.com", Type: TypeAAAA, Class: ClassINET}, 1) != nil {
+		t.Error("other type answered")
+	}
+
+	entry.expire = time.Now()
+	if c.Get(q, 1) != nil {
+		t.Error("expired entry answered")
+	}
+
+	// SERVFAIL and truncated answers are not cached
+	for _, flags := range []uint16{flagQR | RcodeServerFailure, flagQR | flagTC} {
+		b := header(1, flags, 0, 0, 0, 0)
+		m, _ := Parse(b)
+		c.Put(q, b, m)
+		if cachedFor(c, q) != 0 {
+			t.Errorf("flags %#x cached", flags)
+		}
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	c := NewCache(2)
+	put := func(name string) Question {
+		query, _ := Parse(query(t, 1, name, TypeA))
+		q := query.Questions[0]
+		resp, _ := AnswerReply(query, RcodeSuccess, []RR{{Name: q.Name, Type: TypeA, Class: ClassINET, TTL: 60, Data: []byte{192, 0, 2, 1}}})
+		m, _ := Parse(resp)
+		c.Put(q, resp, m)
+		return q
+	}
+	a, b := put("a.test"), put("b.test")
+	c.Get(a, 1)
+	cq := put("c.test")
+	if c.Get(b, 1) != nil {
+		t.Error("least recently used entry kept")
+	}
+	if c.Get(a, 1) == nil || c.Get(cq, 1) == nil {
+		t.Error("recent entries evicted")
+	}
+}
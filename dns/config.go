@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config is read from a file starting with "ON" or "OFF" followed by
+// "key value" pairs:
+//
+//	listen   127.0.0.1:53  address to serve on
+//	local    223.5.5.5:53  resolver for direct names, default from resolv.conf
+//	proxy    8.8.8.8:53    resolver reached through the proxy chain
+//
+// local and proxy take any form accepted by ParseUpstream, plain DNS to
+// the proxy resolver goes over TCP.
+//
+//	fallback local         upstream to retry with on failure: local, proxy or none
+//	cache    4096          number of cached answers, 0 disables the cache
+//	minttl   0             lower bound on cached TTLs
+//	maxttl   86400         upper bound on cached TTLs
+//	fakeip   198.18.0.0/15 answer proxied names with addresses from this range
+//	fakeip-size  65536     number of fake-ip mappings kept
+//	fakeip-file  fakeip.db where fake-ip mappings are kept across restarts
+type Config struct {
+	On        bool
+	Listen    string
+	Local     string
+	Proxy     string
+	Fallback  string
+	CacheSize int
+	MinTTL    uint32
+	MaxTTL    uint32
+
+	FakeIP     string
+	FakeIPSize int
+	FakeIPFile string
+}
+
+func ParseConfig(name string) (*Config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	conf := &Config{
+		Listen:    "127.0.0.1:53",
+		Proxy:     "8.8.8.8:53",
+		Fallback:  "none",
+		CacheSize: 4096,
+		MaxTTL:    86400,
+
+		FakeIPSize: 65536,
+		FakeIPFile: "fakeip.db",
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+
+	scanner.Scan()
+	state := scanner.Text()
+	if state == "ON" {
+		conf.On = true
+	} else if state == "OFF" {
+		conf.On = false
+	} else {
+		return nil, errors.New("first word should be \"ON\" or \"OFF\"")
+	}
+
+	for scanner.Scan() {
+		key := scanner.Text()
+		if !scanner.Scan() {
+			return nil, errors.New("missing value for " + key)
+		}
+		value := scanner.Text()
+		switch key {
+		case "listen":
+			conf.Listen = value
+		case "local":
+			conf.Local = value
+		case "proxy":
+			conf.Proxy = value
+		case "fallback":
+			if value != "local" && value != "proxy" && value != "none" {
+				return nil, errors.New("fallback should be local, proxy or none")
+			}
+			conf.Fallback = value
+		case "fakeip":
+			if _, _, err := net.ParseCIDR(value); err != nil {
+				return nil, errors.New("invalid fakeip range " + value)
+			}
+			conf.FakeIP = value
+		case "fakeip-file":
+			conf.FakeIPFile = value
+		case "cache", "minttl", "maxttl", "fakeip-size":
+			num, err := strconv.ParseUint(value, 10, 31)
+			if err != nil {
+				return nil, errors.New("invalid number for " + key)
+			}
+			switch key {
+			case "cache":
+				conf.CacheSize = int(num)
+			case "minttl":
+				conf.MinTTL = uint32(num)
+			case "maxttl":
+				conf.MaxTTL = uint32(num)
+			case "fakeip-size":
+				conf.FakeIPSize = int(num)
+			}
+		default:
+			return nil, errors.New("unknown key " + key)
+		}
+	}
+	if conf.Local == "" {
+		conf.Local = SystemNameserver()
+	}
+	return conf, nil
+}
+
+// SystemNameserver returns the first nameserver of /etc/resolv.conf, or
+// 127.0.0.53:53 if there is none.
+func SystemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.53:53"
+}
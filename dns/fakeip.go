@@ -0,0 +1,230 @@
+package dns
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FakeIP hands out synthetic addresses from a reserved range and remembers
+// which name each one stands for, so a connection to the address can be
+// turned back into a connection to the name. At most max mappings are
+// kept; the least recently used one is recycled first.
+type FakeIP struct {
+	mu     sync.Mutex
+	ipNet  *net.IPNet
+	v4     bool
+	size   uint32
+	next   uint32
+	max    int
+	order  *list.List
+	byName map[string]*list.Element
+	byIP   map[uint32]*list.Element
+	dirty  bool
+}
+
+type fakeEntry struct {
+	name   string
+	offset uint32
+}
+
+// NewFakeIP creates a pool over cidr, e.g. 198.18.0.0/15. For IPv6 ranges
+// only the low 32 bits are used.
+func NewFakeIP(cidr string, max int) (*FakeIP, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipNet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits > 32 {
+		hostBits = 32
+	}
+	if hostBits < 2 {
+		return nil, errors.New("fake-ip range too small")
+	}
+	size := uint32(1<<hostBits - 1)
+	if max <= 0 || uint32(max) > size-2 {
+		max = int(size - 2)
+	}
+	return &FakeIP{
+		ipNet:  ipNet,
+		v4:     ipNet.IP.To4() != nil,
+		size:   size,
+		next:   1,
+		max:    max,
+		order:  list.New(),
+		byName: make(map[string]*list.Element),
+		byIP:   make(map[uint32]*list.Element),
+	}, nil
+}
+
+// IPv4 reports whether the pool hands out IPv4 addresses.
+func (f *FakeIP) IPv4() bool {
+	return f.v4
+}
+
+func (f *FakeIP) Contains(ip net.IP) bool {
+	return f.ipNet.Contains(ip)
+}
+
+func (f *FakeIP) ip(offset uint32) net.IP {
+	ip := make(net.IP, len(f.ipNet.IP))
+	copy(ip, f.ipNet.IP)
+	n := len(ip)
+	binary.BigEndian.PutUint32(ip[n-4:], binary.BigEndian.Uint32(ip[n-4:])|offset)
+	return ip
+}
+
+func (f *FakeIP) offset(ip net.IP) (uint32, bool) {
+	if !f.ipNet.Contains(ip) {
+		return 0, false
+	}
+	if f.v4 {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	n := len(ip)
+	return binary.BigEndian.Uint32(ip[n-4:]) & f.size, true
+}
+
+// Lookup returns the address for name, allocating one if needed.
+func (f *FakeIP) Lookup(name string) net.IP {
+	name = CanonicalName(name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.byName[name]; ok {
+		f.order.MoveToFront(e)
+		return f.ip(e.Value.(*fakeEntry).offset)
+	}
+	for f.order.Len() >= f.max {
+		f.remove(f.order.Back())
+	}
+	// skip the network and broadcast addresses and those still in use
+	for {
+		offset := f.next
+		f.next++
+		if f.next >= f.size {
+			f.next = 1
+		}
+		if _, used := f.byIP[offset]; !used {
+			f.add(name, offset)
+			return f.ip(offset)
+		}
+	}
+}
+
+// Name returns the name ip was handed out for.
+func (f *FakeIP) Name(ip net.IP) (string, bool) {
+	offset, ok := f.offset(ip)
+	if !ok {
+		return "", false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.byIP[offset]
+	if !ok {
+		return "", false
+	}
+	f.order.MoveToFront(e)
+	return e.Value.(*fakeEntry).name, true
+}
+
+func (f *FakeIP) add(name string, offset uint32) {
+	e := f.order.PushFront(&fakeEntry{name: name, offset: offset})
+	f.byName[name] = e
+	f.byIP[offset] = e
+	f.dirty = true
+}
+
+func (f *FakeIP) remove(e *list.Element) {
+	entry := e.Value.(*fakeEntry)
+	f.order.Remove(e)
+	delete(f.byName, entry.name)
+	delete(f.byIP, entry.offset)
+	f.dirty = true
+}
+
+// Load restores mappings saved by Save. A missing file is not an error.
+// Mappings outside the current range are dropped.
+func (f *FakeIP) Load(name string) error {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanWords)
+	// least recently used first
+	for scanner.Scan() {
+		ip := net.ParseIP(scanner.Text())
+		if !scanner.Scan() {
+			return errors.New("missing name for " + ip.String())
+		}
+		host := scanner.Text()
+		offset, ok := f.offset(ip)
+		if !ok || offset == 0 || offset >= f.size {
+			continue
+		}
+		if e, ok := f.byName[host]; ok {
+			f.remove(e)
+		}
+		if e, ok := f.byIP[offset]; ok {
+			f.remove(e)
+		}
+		f.add(host, offset)
+		if offset >= f.next {
+			f.next = offset + 1
+			if f.next >= f.size {
+				f.next = 1
+			}
+		}
+	}
+	for f.order.Len() > f.max {
+		f.remove(f.order.Back())
+	}
+	f.dirty = false
+	return scanner.Err()
+}
+
+// Save writes the mappings to name if they changed since the last Load or
+// Save. The file is replaced atomically.
+func (f *FakeIP) Save(name string) error {
+	f.mu.Lock()
+	if !f.dirty {
+		f.mu.Unlock()
+		return nil
+	}
+	var b strings.Builder
+	for e := f.order.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*fakeEntry)
+		fmt.Fprintf(&b, "%s %s\n", f.ip(entry.offset), entry.name)
+	}
+	f.dirty = false
+	f.mu.Unlock()
+
+	tmp := name + ".tmp"
+	err := os.WriteFile(tmp, []byte(b.String()), 0644)
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		f.mu.Lock()
+		f.dirty = true
+		f.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFakeIPWraparound(t *testing.T) {
+	// 14 usable addresses, .1 to .14
+	f, err := NewFakeIP("198.18.0.0/28", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.IPv4() || f.max != 13 {
+		t.Fatalf("v4 %v max %d", f.IPv4(), f.max)
+	}
+	seen := make(map[string]string)
+	for i := 1; i <= 13; i++ {
+		name := fmt.Sprintf("n%d.test", i)
+		ip := f.Lookup(name)
+		if want := net.IPv4(198, 18, 0, byte(i)); !ip.Equal(want) {
+			t.Fatalf("%s: got %s, want %s", name, ip, want)
+		}
+		seen[ip.String()] = name
+	}
+	// the same name keeps its address
+	if ip := f.Lookup("N1.test."); !ip.Equal(net.IPv4(198, 18, 0, 1)) {
+		t.Errorf("n1 moved to %s", ip)
+	}
+
+	// full: the least recently used, n2, is recycled, and the next free
+	// address after .13 is .14
+	ip := f.Lookup("new.test")
+	if !ip.Equal(net.IPv4(198, 18, 0, 14)) {
+		t.Errorf("new.test got %s", ip)
+	}
+	if _, ok := f.Name(net.IPv4(198, 18, 0, 2)); ok {
+		t.Error("n2 not evicted")
+	}
+	// wrapped around, skipping .0 and addresses still in use: only .2 is
+	// free
+	ip = f.Lookup("wrapped.test")
+	if !ip.Equal(net.IPv4(198, 18, 0, 2)) {
+		t.Errorf("wrapped.test got %s", ip)
+	}
+	if _, ok := f.Name(net.IPv4(198, 18, 0, 3)); ok {
+		t.Error("n3 not evicted")
+	}
+	for i := 0; i < 100; i++ {
+		ip := f.Lookup(fmt.Sprintf("churn%d.test", i)).To4()
+		if ip[3] == 0 || ip[3] == 15 {
+			t.Fatalf("handed out %s", ip)
+		}
+	}
+	if f.order.Len() != 13 || len(f.byIP) != 13 || len(f.byName) != 13 {
+		t.Errorf("%d entries", f.order.Len())
+	}
+}
+
+func TestFakeIPName(t *testing.T) {
+	f, _ := NewFakeIP("fd00::/120", 4)
+	if f.IPv4() {
+		t.Fatal("IPv6 pool reported as IPv4")
+	}
+	ip := f.Lookup("v6.test")
+	if !ip.Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("got %s", ip)
+	}
+	if name, ok := f.Name(ip); !ok || name != "v6.test" {
+		t.Errorf("name %q", name)
+	}
+	for _, other := range []string{"fd00::2", "fd01::1", "198.18.0.1"} {
+		if _, ok := f.Name(net.ParseIP(other)); ok {
+			t.Errorf("%s mapped", other)
+		}
+	}
+	if _, err := NewFakeIP("198.18.0.0/31", 0); err == nil {
+		t.Error("tiny range accepted")
+	}
+}
+
+func TestFakeIPPersist(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "fakeip.db")
+	f, _ := NewFakeIP("198.18.0.0/24", 3)
+	if err := f.Load(name); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	a, b, c := f.Lookup("a.test"), f.Lookup("b.test"), f.Lookup("c.test")
+	f.Name(a) // a is now the most recently used
+	if err := f.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(name)
+	if want := "198.18.0.2 b.test\n198.18.0.3 c.test\n198.18.0.1 a.test\n"; string(data) != want {
+		t.Errorf("saved:\n%s", data)
+	}
+	// nothing changed, nothing written
+	os.Remove(name)
+	if err := f.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("unchanged mappings written")
+	}
+	f.Lookup("d.test")
+	if err := f.Save(name); err != nil {
+		t.Fatal(err)
+	}
+
+	g, _ := NewFakeIP("198.18.0.0/24", 3)
+	if err := g.Load(name); err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{a.String(): "a.test", c.String(): "c.test", "198.18.0.4": "d.test"} {
+		if got, ok := g.Name(net.ParseIP(ip)); !ok || got != want {
+			t.Errorf("%s: got %q", ip, got)
+		}
+	}
+	if _, ok := g.Name(b); ok {
+		t.Error("evicted mapping restored")
+	}
+	// new addresses continue after the restored ones
+	if ip := g.Lookup("e.test"); !ip.Equal(net.IPv4(198, 18, 0, 5)) {
+		t.Errorf("e.test got %s", ip)
+	}
+
+	// a smaller pool keeps the most recent, a different range drops all
+	data = []byte("198.18.0.1 a.test\n198.18.0.2 b.test\n198.18.0.3 c.test\n10.0.0.1 other.test\n198.18.0.0 zero.test\n")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := NewFakeIP("198.18.0.0/24", 2)
+	if err := h.Load(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.Name(net.IPv4(198, 18, 0, 1)); ok || h.order.Len() != 2 {
+		t.Errorf("%d mappings after load", h.order.Len())
+	}
+	if err := os.WriteFile(name, []byte("198.18.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Load(name); err == nil {
+		t.Error("missing name accepted")
+	}
+}
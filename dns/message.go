@@ -0,0 +1,333 @@
+// Package dns implements the small part of DNS the proxy needs: parsing and
+// building messages, upstream exchanges, caching and a UDP/TCP server.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	TypeA     = 1
+	TypeNS    = 2
+	TypeCNAME = 5
+	TypeSOA   = 6
+	TypePTR   = 12
+	TypeMX    = 15
+	TypeTXT   = 16
+	TypeAAAA  = 28
+	TypeOPT   = 41
+
+	ClassINET = 1
+)
+
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+)
+
+const headerLen = 12
+
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// RR is a resource record. Data is kept as found on the wire, so it may
+// hold compression pointers into the message it was parsed from.
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+	// offset of the TTL field in the parsed message
+	ttlOff int
+}
+
+type Message struct {
+	ID         uint16
+	Flags      uint16
+	Questions  []Question
+	Answers    []RR
+	Authority  []RR
+	Additional []RR
+}
+
+func (m *Message) Response() bool  { return m.Flags&flagQR != 0 }
+func (m *Message) Truncated() bool { return m.Flags&flagTC != 0 }
+func (m *Message) Rcode() int      { return int(m.Flags & 0xf) }
+
+// Question returns the first question, which is the only one used in
+// practice.
+func (m *Message) Question() (Question, bool) {
+	if len(m.Questions) == 0 {
+		return Question{}, false
+	}
+	return m.Questions[0], true
+}
+
+// IPs returns the addresses in the A and AAAA answers.
+func (m *Message) IPs() []net.IP {
+	var ips []net.IP
+	for _, rr := range m.Answers {
+		if (rr.Type == TypeA && len(rr.Data) == 4) || (rr.Type == TypeAAAA && len(rr.Data) == 16) {
+			ips = append(ips, net.IP(rr.Data))
+		}
+	}
+	return ips
+}
+
+// UDPSize is the largest UDP response the sender of m accepts.
+func (m *Message) UDPSize() int {
+	for _, rr := range m.Additional {
+		if rr.Type == TypeOPT && rr.Class > 512 {
+			return int(rr.Class)
+		}
+	}
+	return 512
+}
+
+var errShort = errors.New("dns: message too short")
+
+func Parse(b []byte) (*Message, error) {
+	if len(b) < headerLen {
+		return nil, errShort
+	}
+	m := &Message{
+		ID:    binary.BigEndian.Uint16(b[0:2]),
+		Flags: binary.BigEndian.Uint16(b[2:4]),
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:6]))
+	an := int(binary.BigEndian.Uint16(b[6:8]))
+	ns := int(binary.BigEndian.Uint16(b[8:10]))
+	ar := int(binary.BigEndian.Uint16(b[10:12]))
+
+	off := headerLen
+	for i := 0; i < qd; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+4 > len(b) {
+			return nil, errShort
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[off : off+2]),
+			Class: binary.BigEndian.Uint16(b[off+2 : off+4]),
+		})
+		off += 4
+	}
+	var err error
+	for _, section := range []struct {
+		rrs   *[]RR
+		count int
+	}{{&m.Answers, an}, {&m.Authority, ns}, {&m.Additional, ar}} {
+		for i := 0; i < section.count; i++ {
+			var rr RR
+			rr, off, err = readRR(b, off)
+			if err != nil {
+				return nil, err
+			}
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+	return m, nil
+}
+
+func readRR(b []byte, off int) (RR, int, error) {
+	var rr RR
+	name, off, err := readName(b, off)
+	if err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(b) {
+		return rr, 0, errShort
+	}
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(b[off : off+2])
+	rr.Class = binary.BigEndian.Uint16(b[off+2 : off+4])
+	rr.ttlOff = off + 4
+	rr.TTL = binary.BigEndian.Uint32(b[off+4 : off+8])
+	length := int(binary.BigEndian.Uint16(b[off+8 : off+10]))
+	off += 10
+	if off+length > len(b) {
+		return rr, 0, errShort
+	}
+	rr.Data = b[off : off+length]
+	return rr, off + length, nil
+}
+
+// readName decodes a possibly compressed name at off and returns it with
+// the offset just past it.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errShort
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errShort
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			jumps++
+			if jumps > 32 {
+				return "", 0, errors.New("dns: too many compression pointers")
+			}
+			off = int(binary.BigEndian.Uint16(b[off:off+2]) & 0x3fff)
+		case n&0xc0 != 0:
+			return "", 0, errors.New("dns: invalid label")
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errShort
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// soaMinimum returns the MINIMUM field of rr, an SOA record parsed from
+// msg. The names before it may point anywhere into msg.
+func soaMinimum(msg []byte, rr RR) (uint32, bool) {
+	start := rr.ttlOff + 6
+	end := start + len(rr.Data)
+	if rr.Type != TypeSOA || rr.ttlOff < headerLen || end > len(msg) {
+		return 0, false
+	}
+	// MNAME and RNAME
+	_, off, err := readName(msg, start)
+	if err != nil {
+		return 0, false
+	}
+	_, off, err = readName(msg, off)
+	if err != nil || off+20 > end {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(msg[off+16 : off+20]), true
+}
+
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, errors.New("dns: invalid name " + name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Pack encodes m without name compression. RR data is copied verbatim, so
+// records parsed from another message must not contain compressed names.
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, 0, 512)
+	b = appendUint16(b, m.ID)
+	b = appendUint16(b, m.Flags)
+	b = appendUint16(b, uint16(len(m.Questions)))
+	b = appendUint16(b, uint16(len(m.Answers)))
+	b = appendUint16(b, uint16(len(m.Authority)))
+	b = appendUint16(b, uint16(len(m.Additional)))
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+	for _, section := range [][]RR{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if b, err = appendName(b, rr.Name); err != nil {
+				return nil, err
+			}
+			b = appendUint16(b, rr.Type)
+			b = appendUint16(b, rr.Class)
+			b = appendUint32(b, rr.TTL)
+			b = appendUint16(b, uint16(len(rr.Data)))
+			b = append(b, rr.Data...)
+		}
+	}
+	return b, nil
+}
+
+// NewQuery builds a recursive query for name.
+func NewQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	m := &Message{
+		ID:        id,
+		Flags:     flagRD,
+		Questions: []Question{{Name: name, Type: qtype, Class: ClassINET}},
+	}
+	return m.Pack()
+}
+
+// Reply builds an empty response to query with the given rcode.
+func Reply(query *Message, rcode int) ([]byte, error) {
+	return AnswerReply(query, rcode, nil)
+}
+
+// AnswerReply builds a response to query carrying answers.
+func AnswerReply(query *Message, rcode int, answers []RR) ([]byte, error) {
+	m := &Message{
+		ID:        query.ID,
+		Flags:     flagQR | flagRA | query.Flags&flagRD | uint16(rcode&0xf),
+		Questions: query.Questions,
+		Answers:   answers,
+	}
+	return m.Pack()
+}
+
+// Truncate cuts a packed response down to its header and question with the
+// TC bit set, telling the client to retry over TCP.
+func Truncate(resp []byte, query *Message) ([]byte, error) {
+	m := &Message{
+		ID:        query.ID,
+		Flags:     binary.BigEndian.Uint16(resp[2:4]) | flagTC,
+		Questions: query.Questions,
+	}
+	return m.Pack()
+}
+
+// CanonicalName lowercases name and strips the trailing dot.
+func CanonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,190 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// header returns a message header with the given section counts.
+func header(id, flags uint16, qd, an, ns, ar uint16) []byte {
+	var b []byte
+	for _, v := range []uint16{id, flags, qd, an, ns, ar} {
+		b = appendUint16(b, v)
+	}
+	return b
+}
+
+func TestPackParse(t *testing.T) {
+	m := &Message{
+		ID:        0x1234,
+		Flags:     flagQR | flagRD | flagRA | RcodeNameError,
+		Questions: []Question{{Name: "example.com.", Type: TypeA, Class: ClassINET}},
+		Answers: []RR{
+			{Name: "example.com.", Type: TypeA, Class: ClassINET, TTL: 300, Data: []byte{192, 0, 2, 1}},
+			{Name: "example.com.", Type: TypeAAAA, Class: ClassINET, TTL: 60, Data: net.ParseIP("2001:db8::1")},
+		},
+		Authority:  []RR{{Name: "com.", Type: TypeNS, Class: ClassINET, TTL: 3600, Data: []byte{1, 'a', 0}}},
+		Additional: []RR{{Name: ".", Type: TypeOPT, Class: 1232}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != m.ID || got.Flags != m.Flags || !got.Response() || got.Truncated() || got.Rcode() != RcodeNameError {
+		t.Errorf("header: got %#x %#x", got.ID, got.Flags)
+	}
+	if q, ok := got.Question(); !ok || q != m.Questions[0] {
+		t.Errorf("question %+v", q)
+	}
+	if len(got.Answers) != 2 || len(got.Authority) != 1 || len(got.Additional) != 1 {
+		t.Fatalf("sections %d %d %d", len(got.Answers), len(got.Authority), len(got.Additional))
+	}
+	for i, rr := range got.Answers {
+		want := m.Answers[i]
+		if rr.Name != want.Name || rr.Type != want.Type || rr.TTL != want.TTL || !bytes.Equal(rr.Data, want.Data) {
+			t.Errorf("answer %d: got %+v", i, rr)
+		}
+	}
+	ips := got.IPs()
+	if len(ips) != 2 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) || !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("IPs %v", ips)
+	}
+	if got.UDPSize() != 1232 {
+		t.Errorf("UDPSize %d", got.UDPSize())
+	}
+	if (&Message{}).UDPSize() != 512 {
+		t.Error("UDPSize without OPT")
+	}
+}
+
+func TestParseCompressed(t *testing.T) {
+	b := header(1, flagQR, 1, 2, 0, 0)
+	// question www.example.com at offset 12, example.com at 16
+	b, _ = appendName(b, "www.example.com")
+	b = append(b, 0, TypeCNAME, 0, ClassINET)
+	// answer named by a pointer to the question
+	b = append(b, 0xc0, 12, 0, TypeCNAME, 0, ClassINET, 0, 0, 0, 60, 0, 7)
+	cnameData := len(b)
+	// mail + pointer to example.com
+	b = append(b, 4, 'm', 'a', 'i', 'l', 0xc0, 16)
+	// a label followed by a pointer to the CNAME data, itself ending in a
+	// pointer
+	b = append(b, 2, 'v', '6', 0xc0, byte(cnameData), 0, TypeA, 0, ClassINET, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+
+	m, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Answers[0].Name != "www.example.com." {
+		t.Errorf("pointer name %q", m.Answers[0].Name)
+	}
+	if name, _, err := readName(b, cnameData); err != nil || name != "mail.example.com." {
+		t.Errorf("cname data %q %v", name, err)
+	}
+	if m.Answers[1].Name != "v6.mail.example.com." || !bytes.Equal(m.Answers[1].Data, []byte{192, 0, 2, 1}) {
+		t.Errorf("chained pointers %+v", m.Answers[1])
+	}
+	// the TTL offset points into the message, as the cache expects
+	if off := m.Answers[1].ttlOff; b[off+3] != 60 {
+		t.Errorf("ttl offset %d", off)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	q := header(1, 0, 1, 0, 0, 0)
+	q, _ = appendName(q, "example.com")
+	q = append(q, 0, TypeA, 0, ClassINET)
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"short header", q[:11]},
+		{"name past the end", q[:16]},
+		{"question without type", q[:len(q)-2]},
+		{"more questions than sent", append(header(1, 0, 2, 0, 0, 0), q[12:]...)},
+		{"pointer loop", append(header(1, 0, 1, 0, 0, 0), 0xc0, 12, 0, 1, 0, 1)},
+		{"pointer to pointer loop", append(header(1, 0, 1, 0, 0, 0), 0xc0, 14, 0xc0, 12, 0, 1, 0, 1)},
+		{"pointer past the end", append(header(1, 0, 1, 0, 0, 0), 0xc0, 200, 0, 1, 0, 1)},
+		{"half a pointer", append(header(1, 0, 1, 0, 0, 0), 0xc0)},
+		{"reserved label type", append(header(1, 0, 1, 0, 0, 0), 0x80, 0, 0, 1, 0, 1)},
+		{"answer without header", append(append(header(1, 0, 1, 1, 0, 0), q[12:]...), 0, 0, 1)},
+		{"data past the end", append(append(header(1, 0, 1, 1, 0, 0), q[12:]...), 0, 0, 1, 0, 1, 0, 0, 0, 1, 0, 4, 1, 2)},
+	}
+	for _, tt := range tests {
+		if m, err := Parse(tt.b); err == nil {
+			t.Errorf("%s: parsed %+v", tt.name, m)
+		}
+	}
+	if _, err := Parse(q); err != nil {
+		t.Errorf("valid query: %v", err)
+	}
+}
+
+func TestAppendName(t *testing.T) {
+	for _, name := range []string{"", ".", "com", "example.com."} {
+		b, err := appendName(nil, name)
+		if err != nil {
+			t.Errorf("%q: %v", name, err)
+			continue
+		}
+		got, end, err := readName(b, 0)
+		want := strings.TrimSuffix(name, ".") + "."
+		if err != nil || got != want || end != len(b) {
+			t.Errorf("%q: read back %q %d %v", name, got, end, err)
+		}
+	}
+	for _, name := range []string{"a..b", ".com", strings.Repeat("x", 64) + ".com"} {
+		if _, err := appendName(nil, name); err == nil {
+			t.Errorf("%q: no error", name)
+		}
+	}
+}
+
+func TestReplies(t *testing.T) {
+	b, err := NewQuery(7, "Example.COM.", TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Response() || query.Flags&flagRD == 0 {
+		t.Errorf("query flags %#x", query.Flags)
+	}
+
+	resp, err := Reply(query, RcodeRefused)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := Parse(resp)
+	if m.ID != 7 || !m.Response() || m.Rcode() != RcodeRefused || m.Flags&flagRD == 0 || len(m.Questions) != 1 {
+		t.Errorf("reply %+v", m)
+	}
+
+	var answers []RR
+	for i := 0; i < 40; i++ {
+		answers = append(answers, RR{Name: "example.com.", Type: TypeAAAA, Class: ClassINET, TTL: 60, Data: make([]byte, 16)})
+	}
+	resp, _ = AnswerReply(query, RcodeSuccess, answers)
+	short, err := Truncate(resp, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ = Parse(short)
+	if !m.Truncated() || len(m.Answers) != 0 || m.ID != 7 || len(m.Questions) != 1 || len(short) > 512 {
+		t.Errorf("truncated %+v", m)
+	}
+
+	if got := CanonicalName("Example.COM."); got != "example.com" {
+		t.Errorf("CanonicalName %q", got)
+	}
+}
@@ -0,0 +1,144 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// DoHUpstream sends queries as DNS over HTTPS (RFC 8484) POST requests.
+type DoHUpstream struct {
+	URL string
+	// Client defaults to one dialing through Dial, or directly.
+	Client *http.Client
+	Dial   DialFunc
+	once   sync.Once
+}
+
+func (u *DoHUpstream) client() *http.Client {
+	u.once.Do(func() {
+		if u.Client != nil {
+			return
+		}
+		u.Client = http.DefaultClient
+		if u.Dial != nil {
+			u.Client = &http.Client{Transport: &http.Transport{DialContext: u.Dial, ForceAttemptHTTP2: true}}
+		}
+	})
+	return u.Client
+}
+
+func (u *DoHUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < headerLen {
+		return nil, errShort
+	}
+	// the ID should be 0 for better HTTP caching
+	msg := make([]byte, len(query))
+	copy(msg, query)
+	msg[0], msg[1] = 0, 0
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: DoH status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < headerLen {
+		return nil, errShort
+	}
+	body[0], body[1] = query[0], query[1]
+	return body, nil
+}
+
+// DoTUpstream sends queries as DNS over TLS (RFC 7858).
+type DoTUpstream struct {
+	Addr string
+	// ServerName is verified against the certificate, defaults to the host
+	// of Addr.
+	ServerName string
+	// TLSConfig is cloned for each connection, nil for the defaults.
+	TLSConfig *tls.Config
+	Dial      DialFunc
+}
+
+func (u *DoTUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dial := u.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	raw, err := dial(ctx, "tcp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if u.TLSConfig != nil {
+		config = u.TLSConfig.Clone()
+	}
+	if u.ServerName != "" {
+		config.ServerName = u.ServerName
+	} else if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(u.Addr)
+	}
+	conn := tls.Client(raw, config)
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	if err = conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return exchangeStream(conn, query)
+}
+
+// Parallel sends each query to all upstreams at once and returns the first
+// valid answer, i.e. one that parses and is not SERVFAIL or REFUSED.
+type Parallel []Upstream
+
+func (p Parallel) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(p) == 0 {
+		return nil, errors.New("no upstream")
+	}
+	if len(p) == 1 {
+		return exchange(ctx, p[0], query)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		resp []byte
+		err  error
+	}
+	results := make(chan result, len(p))
+	for _, upstream := range p {
+		go func(upstream Upstream) {
+			resp, err := exchange(ctx, upstream, query)
+			results <- result{resp, err}
+		}(upstream)
+	}
+	var firstErr error
+	for range p {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return nil, firstErr
+}
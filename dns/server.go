@@ -0,0 +1,199 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Server answers DNS queries over UDP and TCP, sending each one either to
+// the local upstream or through the proxy as decided by Route.
+type Server struct {
+	// Route reports whether name should be resolved through the proxy.
+	Route func(name string) bool
+	Local Upstream
+	Proxy Upstream
+	// Fallback is tried when the chosen upstream fails, may be nil.
+	Fallback Upstream
+	// Cache may be nil to disable caching.
+	Cache *Cache
+	// FakeIP, if set, answers address queries for proxied names with
+	// synthetic addresses instead of asking an upstream.
+	FakeIP  *FakeIP
+	Timeout time.Duration
+}
+
+// ListenAndServe serves UDP and TCP on addr until one of them fails.
+func (s *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	errc := make(chan error, 2)
+	go func() { errc <- s.ServeUDP(pc) }()
+	go func() { errc <- s.ServeTCP(l) }()
+	return <-errc
+}
+
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			resp, m := s.handle(query)
+			if resp == nil {
+				return
+			}
+			if len(resp) > m.UDPSize() {
+				if resp, err = Truncate(resp, m); err != nil {
+					return
+				}
+			}
+			pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (s *Server) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveStream(conn)
+	}
+}
+
+func (s *Server) serveStream(conn net.Conn) {
+	defer conn.Close()
+	var lenBuf [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp, _ := s.handle(query)
+		if resp == nil {
+			return
+		}
+		msg := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		copy(msg[2:], resp)
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one packed query. It returns nil for garbage that does
+// not deserve an answer.
+func (s *Server) handle(query []byte) ([]byte, *Message) {
+	m, err := Parse(query)
+	if err != nil || m.Response() {
+		return nil, nil
+	}
+	q, ok := m.Question()
+	if !ok {
+		resp, _ := Reply(m, RcodeFormatError)
+		return resp, m
+	}
+	if s.FakeIP != nil && (q.Type == TypeA || q.Type == TypeAAAA) && q.Class == ClassINET &&
+		s.Route != nil && s.Route(CanonicalName(q.Name)) {
+		resp, _ := s.fakeReply(m, q)
+		return resp, m
+	}
+	if s.Cache != nil {
+		if resp := s.Cache.Get(q, m.ID); resp != nil {
+			return resp, m
+		}
+	}
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := s.Resolve(ctx, q, query)
+	if err != nil {
+		fmt.Println("DNS query failed:", CanonicalName(q.Name), err)
+		resp, _ = Reply(m, RcodeServerFailure)
+		return resp, m
+	}
+	return resp, m
+}
+
+// fakeReply answers with a fake address, or with no address for the family
+// the pool does not cover.
+func (s *Server) fakeReply(m *Message, q Question) ([]byte, error) {
+	if (q.Type == TypeA) != s.FakeIP.IPv4() {
+		return Reply(m, RcodeSuccess)
+	}
+	ip := s.FakeIP.Lookup(q.Name)
+	if q.Type == TypeA {
+		ip = ip.To4()
+	}
+	// short TTL so a recycled address is not cached for long
+	rr := RR{Name: q.Name, Type: q.Type, Class: ClassINET, TTL: 1, Data: ip}
+	return AnswerReply(m, RcodeSuccess, []RR{rr})
+}
+
+// Resolve sends query for q to the upstream chosen by Route, falling back
+// if that fails, and caches the answer.
+func (s *Server) Resolve(ctx context.Context, q Question, query []byte) ([]byte, error) {
+	upstream := s.Local
+	if s.Route != nil && s.Route(CanonicalName(q.Name)) {
+		upstream = s.Proxy
+	}
+	if upstream == nil {
+		return nil, errors.New("no upstream")
+	}
+	resp, err := exchange(ctx, upstream, query)
+	if err != nil && s.Fallback != nil && s.Fallback != upstream {
+		resp, err = exchange(ctx, s.Fallback, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if s.Cache != nil {
+		s.Cache.Put(q, resp, m)
+	}
+	return resp, nil
+}
+
+func exchange(ctx context.Context, upstream Upstream, query []byte) ([]byte, error) {
+	resp, err := upstream.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if m.Rcode() == RcodeServerFailure || m.Rcode() == RcodeRefused {
+		return nil, fmt.Errorf("upstream rcode %d", m.Rcode())
+	}
+	return resp, nil
+}
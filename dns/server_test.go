@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// staticUpstream answers A queries with ip, count times the ip is repeated
+// (once by default), and counts the queries it gets.
+type staticUpstream struct {
+	ip      net.IP
+	count   int
+	rcode   int
+	err     error
+	queries int32
+}
+
+func (u *staticUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	atomic.AddInt32(&u.queries, 1)
+	if u.err != nil {
+		return nil, u.err
+	}
+	m, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	q, _ := m.Question()
+	var answers []RR
+	if q.Type == TypeA && u.rcode == RcodeSuccess {
+		for i := 0; i < u.count || i == 0; i++ {
+			answers = append(answers, RR{Name: q.Name, Type: TypeA, Class: ClassINET, TTL: 60, Data: u.ip.To4()})
+		}
+	}
+	return AnswerReply(m, u.rcode, answers)
+}
+
+func (u *staticUpstream) n() int {
+	return int(atomic.LoadInt32(&u.queries))
+}
+
+// udpServer serves s on a local UDP socket and returns its address.
+func udpServer(t *testing.T, s *Server) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go s.ServeUDP(pc)
+	return pc.LocalAddr().String()
+}
+
+// udpExchange sends query to addr and returns the answer, or nil if there
+// is none within a short time.
+func udpExchange(t *testing.T, addr string, query []byte) *Message {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err = conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	m, err := Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("unparsable answer: %v", err)
+	}
+	return m
+}
+
+func query(t *testing.T, id uint16, name string, qtype uint16) []byte {
+	t.Helper()
+	b, err := NewQuery(id, name, qtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func proxiedTest(name string) bool {
+	return strings.HasSuffix(name, ".proxied.test")
+}
+
+func TestServerRoute(t *testing.T) {
+	local := &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}
+	proxy := &staticUpstream{ip: net.IPv4(192, 0, 2, 2)}
+	addr := udpServer(t, &Server{Route: proxiedTest, Local: local, Proxy: proxy})
+
+	tests := []struct {
+		name string
+		ip   net.IP
+	}{
+		{"www.direct.test", local.ip},
+		{"www.proxied.test", proxy.ip},
+		{"WWW.Proxied.TEST.", proxy.ip},
+	}
+	for i, tt := range tests {
+		m := udpExchange(t, addr, query(t, uint16(i), tt.name, TypeA))
+		if m == nil {
+			t.Fatalf("%s: no answer", tt.name)
+		}
+		if ips := m.IPs(); m.ID != uint16(i) || len(ips) != 1 || !ips[0].Equal(tt.ip) {
+			t.Errorf("%s: got %v, want %v", tt.name, ips, tt.ip)
+		}
+	}
+	if local.n() != 1 || proxy.n() != 2 {
+		t.Errorf("local %d, proxy %d queries", local.n(), proxy.n())
+	}
+}
+
+func TestServerFallback(t *testing.T) {
+	local := &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}
+	failing := &staticUpstream{rcode: RcodeServerFailure}
+	down := &staticUpstream{err: errors.New("unreachable")}
+
+	addr := udpServer(t, &Server{Route: proxiedTest, Local: local, Proxy: failing})
+	m := udpExchange(t, addr, query(t, 1, "a.proxied.test", TypeA))
+	if m == nil || m.Rcode() != RcodeServerFailure {
+		t.Fatalf("without fallback: got %+v", m)
+	}
+	for _, proxy := range []*staticUpstream{failing, down} {
+		addr = udpServer(t, &Server{Route: proxiedTest, Local: local, Proxy: proxy, Fallback: local})
+		m = udpExchange(t, addr, query(t, 2, "a.proxied.test", TypeA))
+		if m == nil || len(m.IPs()) != 1 || !m.IPs()[0].Equal(local.ip) {
+			t.Errorf("with fallback: got %+v", m)
+		}
+	}
+	if failing.n() != 2 || down.n() != 1 {
+		t.Errorf("proxy queries %d, %d", failing.n(), down.n())
+	}
+}
+
+func TestServerCache(t *testing.T) {
+	local := &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}
+	addr := udpServer(t, &Server{Local: local, Cache: NewCache(16)})
+	for id := uint16(1); id <= 3; id++ {
+		m := udpExchange(t, addr, query(t, id, "cached.test", TypeA))
+		if m == nil || m.ID != id || len(m.IPs()) != 1 {
+			t.Fatalf("query %d: got %+v", id, m)
+		}
+	}
+	if local.n() != 1 {
+		t.Errorf("%d upstream queries, want 1", local.n())
+	}
+}
+
+func TestServerFakeIP(t *testing.T) {
+	local := &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}
+	proxy := &staticUpstream{ip: net.IPv4(192, 0, 2, 2)}
+	fake, err := NewFakeIP("198.18.0.0/15", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udpServer(t, &Server{Route: proxiedTest, Local: local, Proxy: proxy, FakeIP: fake})
+
+	m := udpExchange(t, addr, query(t, 1, "a.proxied.test", TypeA))
+	if m == nil || len(m.IPs()) != 1 || !fake.Contains(m.IPs()[0]) || m.Answers[0].TTL != 1 {
+		t.Fatalf("proxied name: got %+v", m)
+	}
+	if name, ok := fake.Name(m.IPs()[0]); !ok || name != "a.proxied.test" {
+		t.Errorf("fake address maps to %q", name)
+	}
+	// no IPv6 fake addresses in an IPv4 pool
+	m = udpExchange(t, addr, query(t, 2, "a.proxied.test", TypeAAAA))
+	if m == nil || m.Rcode() != RcodeSuccess || len(m.Answers) != 0 {
+		t.Errorf("AAAA: got %+v", m)
+	}
+	m = udpExchange(t, addr, query(t, 3, "a.direct.test", TypeA))
+	if m == nil || len(m.IPs()) != 1 || !m.IPs()[0].Equal(local.ip) {
+		t.Errorf("direct name: got %+v", m)
+	}
+	if proxy.n() != 0 {
+		t.Errorf("%d queries to the proxy", proxy.n())
+	}
+}
+
+func TestServerMalformed(t *testing.T) {
+	local := &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}
+	addr := udpServer(t, &Server{Local: local})
+
+	if m := udpExchange(t, addr, []byte{1, 2, 3}); m != nil {
+		t.Errorf("garbage answered: %+v", m)
+	}
+	resp, _ := AnswerReply(&Message{ID: 1}, RcodeSuccess, nil)
+	if m := udpExchange(t, addr, resp); m != nil {
+		t.Errorf("response answered: %+v", m)
+	}
+	m := udpExchange(t, addr, header(5, flagRD, 0, 0, 0, 0))
+	if m == nil || m.ID != 5 || m.Rcode() != RcodeFormatError {
+		t.Errorf("no question: got %+v", m)
+	}
+	if local.n() != 0 {
+		t.Errorf("%d upstream queries", local.n())
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	// 40 answers do not fit in 512 bytes
+	local := &staticUpstream{ip: net.IPv4(192, 0, 2, 1), count: 40}
+	s := &Server{Local: local}
+	addr := udpServer(t, s)
+	m := udpExchange(t, addr, query(t, 1, "big.test", TypeA))
+	if m == nil || !m.Truncated() || len(m.Answers) != 0 {
+		t.Fatalf("over UDP: got %+v", m)
+	}
+
+	// the client retries over TCP and gets everything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.ServeTCP(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for id := uint16(1); id <= 2; id++ {
+		// two queries on one connection
+		resp, err := exchangeStream(conn, query(t, id, "big.test", TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err = Parse(resp); err != nil || m.Truncated() || len(m.Answers) != 40 {
+			t.Errorf("over TCP: got %d answers, %v", len(m.Answers), err)
+		}
+	}
+	// a length prefix without the message closes the connection
+	conn.Write([]byte{0, 30, 1})
+	conn.(*net.TCPConn).CloseWrite()
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err == nil {
+		t.Errorf("answered a partial query of %d bytes", binary.BigEndian.Uint16(lenBuf[:]))
+	}
+}
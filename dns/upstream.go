@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream answers packed DNS queries.
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// DialFunc opens connections for an Upstream, e.g. through a proxy chain.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+const defaultTimeout = 5 * time.Second
+
+// ParseUpstream builds an Upstream from one of
+//
+//	1.1.1.1 or 1.1.1.1:53         plain DNS over UDP
+//	udp://1.1.1.1:53
+//	tcp://1.1.1.1:53
+//	tls://1.1.1.1:853#one.one.one.one  DNS over TLS, the fragment names the server
+//	https://1.1.1.1/dns-query     DNS over HTTPS
+//
+// Connections are opened through dial if it is not nil, in which case
+// plain DNS goes over TCP since dial may not carry UDP.
+func ParseUpstream(spec string, dial DialFunc) (Upstream, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	addr := func(port string) string {
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), port)
+		}
+		return u.Host
+	}
+	switch u.Scheme {
+	case "udp":
+		if dial != nil {
+			return &TCPUpstream{Addr: addr("53"), Dial: dial}, nil
+		}
+		return &UDPUpstream{Addr: addr("53")}, nil
+	case "tcp":
+		return &TCPUpstream{Addr: addr("53"), Dial: dial}, nil
+	case "tls":
+		return &DoTUpstream{Addr: addr("853"), ServerName: u.Fragment, Dial: dial}, nil
+	case "https":
+		u.Fragment = ""
+		return &DoHUpstream{URL: u.String(), Dial: dial}, nil
+	}
+	return nil, errors.New("unsupported upstream " + spec)
+}
+
+// UDPUpstream sends queries over UDP and retries over TCP when the answer
+// is truncated.
+type UDPUpstream struct {
+	Addr string
+}
+
+func (u *UDPUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams for other queries
+		if n < headerLen || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&byte(flagTC>>8) != 0 {
+			tcp := &TCPUpstream{Addr: u.Addr}
+			return tcp.Exchange(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+// TCPUpstream sends queries over TCP, through Dial if set.
+type TCPUpstream struct {
+	Addr string
+	Dial DialFunc
+}
+
+func (u *TCPUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dial := u.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	return exchangeStream(conn, query)
+}
+
+// exchangeStream sends a length-prefixed query on a stream and reads the
+// response, as done for DNS over TCP and TLS.
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < headerLen || resp[0] != query[0] || resp[1] != query[1] {
+		return nil, errors.New("dns: mismatched response")
+	}
+	return resp, nil
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	conn.SetDeadline(deadline)
+}
@@ -0,0 +1,407 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upstreamFunc adapts a function to Upstream.
+type upstreamFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+func (f upstreamFunc) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+// standIn serves s over UDP and TCP on the same local port and returns
+// the address.
+func standIn(t *testing.T, s *Server) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			// the port is taken for TCP, try another
+			pc.Close()
+			continue
+		}
+		t.Cleanup(func() {
+			pc.Close()
+			l.Close()
+		})
+		go s.ServeUDP(pc)
+		go s.ServeTCP(l)
+		return pc.LocalAddr().String()
+	}
+	t.Fatal("no port free for both UDP and TCP")
+	return ""
+}
+
+// exchangeA asks u for the A records of name and returns the answer.
+func exchangeA(ctx context.Context, u Upstream, id uint16, name string) (*Message, error) {
+	q, err := NewQuery(id, name, TypeA)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if m.ID != id {
+		return nil, errors.New("wrong id")
+	}
+	return m, nil
+}
+
+func timeout(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestUDPUpstream(t *testing.T) {
+	addr := standIn(t, &Server{Local: &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}})
+	m, err := exchangeA(timeout(t, 2*time.Second), &UDPUpstream{Addr: addr}, 7, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := m.IPs(); len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("got %v", ips)
+	}
+}
+
+func TestUDPUpstreamTruncated(t *testing.T) {
+	big := &staticUpstream{ip: net.IPv4(192, 0, 2, 1), count: 40}
+	addr := standIn(t, &Server{Local: big})
+	m, err := exchangeA(timeout(t, 2*time.Second), &UDPUpstream{Addr: addr}, 7, "big.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Truncated() || len(m.Answers) != 40 {
+		t.Errorf("got %d answers, truncated %v", len(m.Answers), m.Truncated())
+	}
+	// once over UDP, then again over TCP
+	if big.n() != 2 {
+		t.Errorf("%d queries", big.n())
+	}
+}
+
+func TestUDPUpstreamStray(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		m, _ := Parse(buf[:n])
+		rr := RR{Name: "example.com.", Type: TypeA, Class: ClassINET, TTL: 60, Data: []byte{192, 0, 2, 1}}
+		// an answer to another query and a runt come first
+		other := *m
+		other.ID++
+		stray, _ := AnswerReply(&other, RcodeSuccess, []RR{rr})
+		pc.WriteTo(stray, addr)
+		pc.WriteTo([]byte{buf[0], buf[1]}, addr)
+		resp, _ := AnswerReply(m, RcodeSuccess, []RR{rr})
+		pc.WriteTo(resp, addr)
+	}()
+	m, err := exchangeA(timeout(t, 2*time.Second), &UDPUpstream{Addr: pc.LocalAddr().String()}, 9, "example.com")
+	if err != nil || len(m.IPs()) != 1 {
+		t.Errorf("got %+v, %v", m, err)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	// a UDP socket that never answers, and a TCP listener that accepts
+	// but never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	for _, u := range []Upstream{
+		&UDPUpstream{Addr: pc.LocalAddr().String()},
+		&TCPUpstream{Addr: l.Addr().String()},
+		&DoTUpstream{Addr: l.Addr().String()},
+	} {
+		start := time.Now()
+		_, err := exchangeA(timeout(t, 200*time.Millisecond), u, 1, "example.com")
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("%T: got %v, want a timeout", u, err)
+			}
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%T: took %v", u, d)
+		}
+	}
+}
+
+func TestTCPUpstreamErrors(t *testing.T) {
+	// nothing listening
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+	if _, err := exchangeA(timeout(t, time.Second), &TCPUpstream{Addr: closed}, 1, "example.com"); err == nil {
+		t.Error("closed port: no error")
+	}
+
+	// an answer with another id, then one cut short
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var buf [512]byte
+			conn.Read(buf[:])
+			if i == 0 {
+				conn.Write([]byte{0, 12, 0xff, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+			} else {
+				conn.Write([]byte{0, 12, buf[2], buf[3]})
+			}
+			conn.Close()
+		}
+	}()
+	for _, want := range []string{"mismatched", "EOF"} {
+		_, err := exchangeA(timeout(t, time.Second), &TCPUpstream{Addr: l.Addr().String()}, 1, "example.com")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	}
+}
+
+func TestTCPUpstreamDial(t *testing.T) {
+	addr := standIn(t, &Server{Local: &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}})
+	dialed := ""
+	dial := func(ctx context.Context, network, a string) (net.Conn, error) {
+		dialed = network + " " + a
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	// plain DNS through a dialer goes over TCP
+	u, err := ParseUpstream("192.0.2.53", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exchangeA(timeout(t, time.Second), u, 1, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if dialed != "tcp 192.0.2.53:53" {
+		t.Errorf("dialed %q", dialed)
+	}
+}
+
+func TestDoHUpstream(t *testing.T) {
+	local := &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		if len(query) < 2 || query[0] != 0 || query[1] != 0 {
+			http.Error(w, "id should be 0", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/dns-query":
+			resp, _ := local.Exchange(r.Context(), query)
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(resp)
+		case "/short":
+			w.Write([]byte{0, 0, 0x80})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	u := &DoHUpstream{URL: ts.URL + "/dns-query", Client: ts.Client()}
+	m, err := exchangeA(timeout(t, 2*time.Second), u, 0x1234, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := m.IPs(); len(ips) != 1 || !ips[0].Equal(local.ip) {
+		t.Errorf("got %v", ips)
+	}
+	for path, want := range map[string]string{"/missing": "status 404", "/short": "too short"} {
+		u := &DoHUpstream{URL: ts.URL + path, Client: ts.Client()}
+		if _, err := exchangeA(timeout(t, 2*time.Second), u, 1, "example.com"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", path, err, want)
+		}
+	}
+	// the certificate is not trusted by default
+	u = &DoHUpstream{URL: ts.URL + "/dns-query"}
+	if _, err := exchangeA(timeout(t, 2*time.Second), u, 1, "example.com"); err == nil {
+		t.Error("untrusted certificate accepted")
+	}
+}
+
+func TestDoTUpstream(t *testing.T) {
+	// borrow the test certificate, valid for example.com and 127.0.0.1
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	local := &staticUpstream{ip: net.IPv4(192, 0, 2, 1)}
+	go (&Server{Local: local}).ServeTCP(l)
+
+	u, err := ParseUpstream("tls://"+l.Addr().String()+"#example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := u.(*DoTUpstream)
+	dot.TLSConfig = &tls.Config{RootCAs: roots}
+	m, err := exchangeA(timeout(t, 2*time.Second), dot, 3, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := m.IPs(); len(ips) != 1 || !ips[0].Equal(local.ip) {
+		t.Errorf("got %v", ips)
+	}
+	// the address is used when no name is given
+	dot.ServerName = ""
+	if _, err := exchangeA(timeout(t, 2*time.Second), dot, 4, "example.com"); err != nil {
+		t.Errorf("by address: %v", err)
+	}
+	dot.ServerName = "wrong.test"
+	if _, err := exchangeA(timeout(t, 2*time.Second), dot, 5, "example.com"); err == nil {
+		t.Error("wrong server name accepted")
+	}
+}
+
+func TestParallel(t *testing.T) {
+	answer := func(ip net.IP, delay time.Duration) Upstream {
+		u := &staticUpstream{ip: ip}
+		return upstreamFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+			select {
+			case <-time.After(delay):
+				return u.Exchange(ctx, query)
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+	}
+	servfail := &staticUpstream{rcode: RcodeServerFailure}
+	refused := &staticUpstream{rcode: RcodeRefused}
+	garbage := upstreamFunc(func(context.Context, []byte) ([]byte, error) { return []byte{1}, nil })
+	down := &staticUpstream{err: errors.New("down")}
+	hang := answer(net.IPv4(192, 0, 2, 9), time.Hour)
+
+	tests := []struct {
+		name string
+		p    Parallel
+		ip   net.IP
+		err  bool
+	}{
+		{"fastest", Parallel{answer(net.IPv4(192, 0, 2, 1), 100*time.Millisecond), answer(net.IPv4(192, 0, 2, 2), 0)}, net.IPv4(192, 0, 2, 2), false},
+		{"invalid answers skipped", Parallel{servfail, refused, garbage, down, answer(net.IPv4(192, 0, 2, 3), 50*time.Millisecond)}, net.IPv4(192, 0, 2, 3), false},
+		{"a hanging upstream does not delay", Parallel{hang, answer(net.IPv4(192, 0, 2, 4), 0)}, net.IPv4(192, 0, 2, 4), false},
+		{"single", Parallel{servfail}, nil, true},
+		{"all fail", Parallel{servfail, down}, nil, true},
+		{"none", Parallel{}, nil, true},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		m, err := exchangeA(timeout(t, 2*time.Second), tt.p, 1, "example.com")
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ips := m.IPs(); len(ips) != 1 || !ips[0].Equal(tt.ip) {
+			t.Errorf("%s: got %v, want %s", tt.name, ips, tt.ip)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: took %v", tt.name, d)
+		}
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"1.1.1.1", "*dns.UDPUpstream 1.1.1.1:53"},
+		{"1.1.1.1:5353", "*dns.UDPUpstream 1.1.1.1:5353"},
+		{"udp://[2606:4700::1111]", "*dns.UDPUpstream [2606:4700::1111]:53"},
+		{"tcp://1.1.1.1", "*dns.TCPUpstream 1.1.1.1:53"},
+		{"tls://1.1.1.1#one.one.one.one", "*dns.DoTUpstream 1.1.1.1:853 one.one.one.one"},
+		{"https://1.1.1.1/dns-query#x", "*dns.DoHUpstream https://1.1.1.1/dns-query"},
+	}
+	for _, tt := range tests {
+		u, err := ParseUpstream(tt.spec, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		var got string
+		switch u := u.(type) {
+		case *UDPUpstream:
+			got = "*dns.UDPUpstream " + u.Addr
+		case *TCPUpstream:
+			got = "*dns.TCPUpstream " + u.Addr
+		case *DoTUpstream:
+			got = "*dns.DoTUpstream " + u.Addr + " " + u.ServerName
+		case *DoHUpstream:
+			got = "*dns.DoHUpstream " + u.URL
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+	if _, err := ParseUpstream("quic://1.1.1.1", nil); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+}
@@ -2,65 +2,489 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"proxy/base"
 	"proxy/client"
+	"proxy/dns"
+	"proxy/reverse"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
-	clientAddress := "0.0.0.0:8080"
-	reverseAddr := "127.0.0.1:80"
-	var cl client.Client
+	os.Exit(run(os.Args[1:]))
+}
 
-	err := cl.ParseProxyAddr("proxyAddr.db")
-	if err != nil {
-		fmt.Println("Failed to parse proxy address:", err)
-		return
+func run(args []string) int {
+	command := "client"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "client":
+		return runClient(args)
+	case "server":
+		return runServer(args)
+	case "reverse":
+		return runReverse(args)
+	case "check-config":
+		return runCheckConfig(args)
+	case "test-rule":
+		return runTestRule(args)
+	case "pac":
+		return runPAC(args)
+	case "ca":
+		return runCA(args)
+	case "version":
+		fmt.Println("proxy", version)
+		return exitOK
+	case "help":
+		fmt.Print(usage)
+		return exitOK
 	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+	return exitUsage
+}
 
-	err = cl.ParseRules()
+// proxy client [flags]
+func runClient(args []string) int {
+	var cfg config
+	fs := newFlagSet("client", "")
+	cfg.addrs(fs)
+	cfg.files(fs)
+	supervise := fs.Bool("supervise", false, "run each SOCKS5 server as a child process restarted when it crashes")
+	profile := fs.String("profile", "", "outbound profile for DIRECT connections no rule gives one")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	cl, err := loadClient(&cfg)
 	if err != nil {
-		fmt.Println("Failed to parse rules:", err)
-		return
+		fmt.Println(err)
+		return exitError
+	}
+	if *profile != "" {
+		cl.Outbound = cl.Outbounds[*profile]
+		if cl.Outbound == nil {
+			fmt.Println("Unknown outbound profile:", *profile)
+			return exitError
+		}
 	}
 
-	err = cl.Res.ParseList("reverseList.db")
+	cfg.reverseServer(&cl.Res)
+	err = cl.Res.ParseList(cfg.reverseList)
 	if err != nil {
 		fmt.Println("Failed to parse reverseList:", err)
-		return
+		return exitError
 	}
 	err = cl.Res.ModifyHost()
 	if err != nil {
 		fmt.Println("Failed to modify hosts:", err)
-		return
+		return exitError
 	}
 	defer cl.Res.RestoreHost()
-	go cl.Res.Listen(reverseAddr)
+	go cl.Res.Listen(cfg.reverseListen)
+	go cl.Res.ListenTLS(cfg.reverseTLS)
 
-	clientListener, err := net.Listen("tcp", clientAddress)
+	clientListener, err := net.Listen("tcp", cfg.listen)
 	if err != nil {
 		fmt.Println("Listen failed:", err)
-		return
+		return exitError
 	}
 	defer clientListener.Close()
-	fmt.Printf("Proxy Client is listening on %s\n", clientAddress)
+	fmt.Printf("Proxy Client (SOCKS5/HTTP) is listening on %s\n", cfg.listen)
 
-	for _, addr := range cl.ProxyAddr {
-		cmd := exec.Command("./serverListen", addr)
-		cmd.Start()
-		defer cmd.Process.Kill()
-		fmt.Println("SOCKS5 server is listening on", addr)
+	// the servers dial the last hop with the listener's profile
+	opts := cl.Outbound
+	if opts == nil {
+		opts = &base.DefaultDialOptions
 	}
+	var child []string
+	if *supervise {
+		child = cfg.serverArgs()
+		if *profile != "" {
+			child = append(child, "-profile", *profile)
+		}
+	}
+	stopServers, err := startServers(cl.ProxyAddr, opts, child)
+	if err != nil {
+		fmt.Println("Failed to start SOCKS5 server:", err)
+		return exitError
+	}
+	defer stopServers()
 
-	cl.ProxyAddr = append(cl.ProxyAddr, "127.0.0.1:7891")
+	cl.ProxyAddr = append(cl.ProxyAddr, cfg.lastHop)
 	go cl.Listen(clientListener)
+
+	dnsConf, err := dns.ParseConfig(cfg.dns)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("Failed to parse dns config:", err)
+		return exitError
+	}
+	if err == nil && dnsConf.On {
+		dnsServer, err := cl.DNSServer(dnsConf)
+		if err != nil {
+			fmt.Println("Failed to start DNS server:", err)
+			return exitError
+		}
+		if cl.FakeIP != nil {
+			defer cl.FakeIP.Save(dnsConf.FakeIPFile)
+			go func() {
+				for range time.Tick(time.Minute) {
+					if err := cl.FakeIP.Save(dnsConf.FakeIPFile); err != nil {
+						fmt.Println("Failed to save fake-ip mappings:", err)
+					}
+				}
+			}()
+		}
+		go func() {
+			err := dnsServer.ListenAndServe(dnsConf.Listen)
+			fmt.Println("DNS server stopped:", err)
+		}()
+		fmt.Println("DNS server is listening on", dnsConf.Listen)
+	}
+
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
-	<-signalChannel
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChannel {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		err = cl.ParseRules()
+		if err != nil {
+			fmt.Println("Failed to reload rules:", err)
+			continue
+		}
+		fmt.Println("Rules reloaded")
+	}
 	cl.End = true
 	fmt.Println("\nExit")
+	return exitOK
+}
+
+// proxy server [flags] [addr...]
+func runServer(args []string) int {
+	var cfg config
+	fs := newFlagSet("server", "[addr...]")
+	cfg.files(fs)
+	profile := fs.String("profile", "", "outbound profile to dial with")
+	supervise := fs.Bool("supervise", false, "run each server as a child process restarted when it crashes")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	var cl client.Client
+	err := loadDialing(&cfg, &cl)
+	if err != nil {
+		fmt.Println(err)
+		return exitError
+	}
+	opts := &base.DefaultDialOptions
+	if *profile != "" {
+		opts = cl.Outbounds[*profile]
+		if opts == nil {
+			fmt.Println("Unknown outbound profile:", *profile)
+			return exitError
+		}
+	}
+	addrs := fs.Args()
+	if len(addrs) == 0 {
+		err = cl.ParseProxyAddr(cfg.proxyAddr)
+		if err != nil {
+			fmt.Println("Failed to parse proxy address:", err)
+			return exitError
+		}
+		addrs = cl.ProxyAddr
+	}
+
+	var child []string
+	if *supervise {
+		child = cfg.serverArgs()
+		if *profile != "" {
+			child = append(child, "-profile", *profile)
+		}
+	}
+	stop, err := startServers(addrs, opts, child)
+	if err != nil {
+		fmt.Println("Failed to start SOCKS5 server:", err)
+		return exitError
+	}
+	defer stop()
+	waitSignal()
+	return exitOK
+}
+
+// proxy reverse [flags]
+func runReverse(args []string) int {
+	var cfg config
+	fs := newFlagSet("reverse", "")
+	cfg.addrs(fs)
+	cfg.files(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	var cl client.Client
+	cfg.reverseServer(&cl.Res)
+	err := cl.Res.ParseList(cfg.reverseList)
+	if err != nil {
+		fmt.Println("Failed to parse reverseList:", err)
+		return exitError
+	}
+	if !cl.Res.Enabled() {
+		fmt.Println("Reverse server is OFF in", cfg.reverseList)
+		return exitError
+	}
+	err = cl.Res.ModifyHost()
+	if err != nil {
+		fmt.Println("Failed to modify hosts:", err)
+		return exitError
+	}
+	defer cl.Res.RestoreHost()
+
+	go cl.Res.ListenTLS(cfg.reverseTLS)
+	done := make(chan struct{})
+	go func() {
+		cl.Res.Listen(cfg.reverseListen)
+		close(done)
+	}()
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signalChannel:
+		return exitOK
+	case <-done:
+		return exitError
+	}
+}
+
+// proxy check-config [flags]
+func runCheckConfig(args []string) int {
+	var cfg config
+	fs := newFlagSet("check-config", "")
+	cfg.files(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	code := exitOK
+	report := func(name string, err error, optional bool) {
+		switch {
+		case err == nil:
+			fmt.Println("ok     ", name)
+		case optional && os.IsNotExist(err):
+			fmt.Println("absent ", name, "(optional, using defaults)")
+		default:
+			fmt.Println("error  ", name+":", err)
+			code = exitError
+		}
+	}
+
+	var cl client.Client
+	_, err := base.ParseResolver(cfg.resolver)
+	report(cfg.resolver, err, true)
+	_, cl.Outbounds, err = base.ParseOutbound(cfg.outbound)
+	report(cfg.outbound, err, true)
+	report(cfg.proxyAddr, cl.ParseProxyAddr(cfg.proxyAddr), false)
+	cl.RuleFiles = cfg.ruleFiles()
+	report("rules", cl.ParseRules(), false)
+	report(cfg.reverseList, cl.Res.ParseList(cfg.reverseList), false)
+	_, err = dns.ParseConfig(cfg.dns)
+	report(cfg.dns, err, true)
+	return code
+}
+
+// proxy test-rule [flags] host port
+func runTestRule(args []string) int {
+	var cfg config
+	fs := newFlagSet("test-rule", "host port")
+	cfg.addrs(fs)
+	cfg.files(fs)
+	program := fs.String("program", "", "command line of the connecting process")
+	exe := fs.String("exe", "", "executable path of the connecting process")
+	uid := fs.Int("uid", -1, "user id of the connecting process")
+	gid := fs.Int("gid", -1, "group id of the connecting process")
+	cgroup := fs.String("cgroup", "", "cgroup path of the connecting process")
+	parent := fs.String("parent", "", "parent process name")
+	sni := fs.String("sni", "", "Host header or TLS server name")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+	port, err := strconv.ParseUint(fs.Arg(1), 10, 16)
+	if err != nil {
+		fmt.Println("Invalid port:", fs.Arg(1))
+		return exitUsage
+	}
+
+	cl, err := loadClient(&cfg)
+	if err != nil {
+		fmt.Println(err)
+		return exitError
+	}
+	var proc *client.Process
+	if *exe != "" || *uid >= 0 || *gid >= 0 || *cgroup != "" || *parent != "" {
+		proc = &client.Process{PID: -1, Cmdline: *program, Path: *exe, UID: *uid, GID: *gid, Cgroup: *cgroup, PPID: -1, ParentName: *parent}
+		if *exe != "" {
+			proc.Name = filepath.Base(*exe)
+		}
+	}
+	cl.ProxyAddr = append(cl.ProxyAddr, cfg.lastHop)
+	fmt.Print(cl.Explain(client.Query{Host: fs.Arg(0), Port: uint16(port), Program: *program, Process: proc, SNI: *sni}))
+	return exitOK
+}
+
+// proxy pac [flags] file [proxyAddr]
+func runPAC(args []string) int {
+	var cfg config
+	fs := newFlagSet("pac", "file [proxyAddr]")
+	cfg.files(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return exitUsage
+	}
+	pacProxy := "127.0.0.1:8080"
+	if fs.NArg() > 1 {
+		pacProxy = fs.Arg(1)
+	}
+
+	cl, err := loadClient(&cfg)
+	if err != nil {
+		fmt.Println(err)
+		return exitError
+	}
+	err = cl.WritePAC(fs.Arg(0), pacProxy)
+	if err != nil {
+		fmt.Println("Failed to write PAC file:", err)
+		return exitError
+	}
+	fmt.Println("PAC file written to", fs.Arg(0))
+	return exitOK
+}
+
+// proxy ca [flags]
+func runCA(args []string) int {
+	var certPath, keyPath string
+	fs := newFlagSet("ca", "")
+	envString(fs, &certPath, "ca-cert", "ca.pem", "CA certificate to create")
+	envString(fs, &keyPath, "ca-key", "ca-key.pem", "CA private key to create")
+	keyType := fs.String("key-type", reverse.KeyECDSA, "key type, ecdsa or rsa")
+	validity := fs.Duration("validity", 10*365*24*time.Hour, "how long the CA is valid")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	err := reverse.CreateCA(certPath, keyPath, *keyType, *validity)
+	if err != nil {
+		fmt.Println("Failed to create CA:", err)
+		return exitError
+	}
+	fmt.Println("CA certificate written to", certPath, "and key to", keyPath)
+	fmt.Println("Add", certPath, "to the trusted roots of your system or browser, then add to the reverse list:")
+	fmt.Println("\tca", certPath, keyPath)
+	return exitOK
+}
+
+// loadClient reads the dial options, proxy addresses and rules.
+func loadClient(cfg *config) (*client.Client, error) {
+	cl := &client.Client{RuleFiles: cfg.ruleFiles()}
+	err := loadDialing(cfg, cl)
+	if err != nil {
+		return nil, err
+	}
+	err = cl.ParseProxyAddr(cfg.proxyAddr)
+	if err != nil {
+		return nil, errors.New("Failed to parse proxy address: " + err.Error())
+	}
+	err = cl.ParseRules()
+	if err != nil {
+		return nil, errors.New("Failed to parse rules: " + err.Error())
+	}
+	return cl, nil
+}
+
+// loadDialing reads the resolver and outbound options for direct dials.
+func loadDialing(cfg *config, cl *client.Client) error {
+	err := parseResolver(cfg.resolver)
+	if err != nil {
+		return errors.New("Failed to parse resolver: " + err.Error())
+	}
+	err = parseOutbound(cl, cfg.outbound)
+	if err != nil {
+		return errors.New("Failed to parse outbound options: " + err.Error())
+	}
+	return nil
+}
+
+func (c *config) ruleFiles() client.RuleFiles {
+	return client.RuleFiles{Socks: c.socksRules, Program: c.programRules, Http: c.httpRules}
+}
+
+// serverArgs are the arguments a supervised child server runs with.
+func (c *config) serverArgs() []string {
+	return []string{"server", "-resolver", c.resolver, "-outbound", c.outbound}
+}
+
+// waitSignal blocks until the process is interrupted or terminated.
+func waitSignal() {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	<-signalChannel
+}
+
+// parseResolver sets the resolver for direct dials from name if it exists.
+func parseResolver(name string) error {
+	r, err := base.ParseResolver(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	base.DefaultResolver = r
+	return nil
+}
+
+// parseOutbound sets the options for direct dials and the profiles rules
+// may refer to from name if it exists.
+func parseOutbound(cl *client.Client, name string) error {
+	def, profiles, err := base.ParseOutbound(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	base.DefaultDialOptions = *def
+	cl.Outbound = def
+	cl.Outbounds = profiles
+	return nil
 }
@@ -0,0 +1,366 @@
+package reverse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing strategies.
+const (
+	RoundRobin = "round-robin"
+	LeastConn  = "least-conn"
+	IPHash     = "ip-hash"
+)
+
+var errNoBackend = errors.New("no backend available")
+
+// Backend is one server of a Pool.
+type Backend struct {
+	URL    *url.URL
+	Weight int
+
+	active  int64 // requests in flight
+	current int   // smooth round-robin state, guarded by Pool.mu
+
+	mu       sync.Mutex
+	down     bool // failed active health checks
+	checkRun int  // consecutive checks disagreeing with down
+	failures int  // consecutive failed requests
+	ejected  time.Time
+}
+
+func (b *Backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.down && now.After(b.ejected)
+}
+
+// Pool spreads the requests of a route over its backends. A route lists
+// them as "backend[*weight],backend[*weight]..." and sets the pool up with
+//
+//	lb=round-robin     round-robin, least-conn or ip-hash
+//	check=/healthz     path polled for active health checks, off if empty
+//	check-interval=10s
+//	check-timeout=2s
+//	rise=2             passing checks to bring a backend back
+//	fall=3             failing checks to take a backend down
+//	eject=5            consecutive 5xx answers or dial errors that eject a
+//	                   backend, 0 disables ejection
+//	eject-time=30s     how long an ejected backend is left alone
+//	retries=1          times an idempotent request is retried on another
+//	                   backend after an error or a 502, 503 or 504
+//
+// When no backend is healthy every backend is tried anyway.
+type Pool struct {
+	Backends      []*Backend
+	Strategy      string
+	CheckPath     string
+	CheckInterval time.Duration
+	CheckTimeout  time.Duration
+	Rise          int
+	Fall          int
+	EjectAfter    int
+	EjectTime     time.Duration
+	Retries       int
+
+	mu sync.Mutex
+}
+
+func newPool(list string) (*Pool, error) {
+	p := &Pool{
+		Strategy:      RoundRobin,
+		CheckInterval: 10 * time.Second,
+		CheckTimeout:  2 * time.Second,
+		Rise:          2,
+		Fall:          3,
+		EjectAfter:    5,
+		EjectTime:     30 * time.Second,
+		Retries:       1,
+	}
+	for _, item := range strings.Split(list, ",") {
+		addr, weight, ok := strings.Cut(item, "*")
+		b := &Backend{Weight: 1}
+		if ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w < 1 {
+				return nil, errors.New("invalid weight " + weight)
+			}
+			b.Weight = w
+		}
+		u, err := parseBackend(addr)
+		if err != nil {
+			return nil, err
+		}
+		b.URL = u
+		p.Backends = append(p.Backends, b)
+	}
+	return p, nil
+}
+
+// set applies a pool key of a route line, reporting false for keys that
+// are not the pool's.
+func (p *Pool) set(key, value string) (bool, error) {
+	switch key {
+	case "lb":
+		if value != RoundRobin && value != LeastConn && value != IPHash {
+			return true, errors.New("unknown lb strategy " + value)
+		}
+		p.Strategy = value
+	case "check":
+		p.CheckPath = value
+	case "check-interval", "check-timeout", "eject-time":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return true, errors.New("invalid duration for " + key)
+		}
+		switch key {
+		case "check-interval":
+			p.CheckInterval = d
+		case "check-timeout":
+			p.CheckTimeout = d
+		case "eject-time":
+			p.EjectTime = d
+		}
+	case "rise", "fall", "eject", "retries":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || (n == 0 && (key == "rise" || key == "fall")) {
+			return true, errors.New("invalid number for " + key)
+		}
+		switch key {
+		case "rise":
+			p.Rise = n
+		case "fall":
+			p.Fall = n
+		case "eject":
+			p.EjectAfter = n
+		case "retries":
+			p.Retries = n
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// pick chooses a backend for req among those not in tried.
+func (p *Pool) pick(req *http.Request, tried map[*Backend]bool) *Backend {
+	now := time.Now()
+	var candidates []*Backend
+	for _, b := range p.Backends {
+		if !tried[b] && b.available(now) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, b := range p.Backends {
+			if !tried[b] {
+				candidates = append(candidates, b)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch p.Strategy {
+	case LeastConn:
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			// fewest requests in flight per unit of weight
+			if atomic.LoadInt64(&b.active)*int64(best.Weight) < atomic.LoadInt64(&best.active)*int64(b.Weight) {
+				best = b
+			}
+		}
+		return best
+	case IPHash:
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		h := fnv.New32a()
+		io.WriteString(h, host)
+		total := 0
+		for _, b := range candidates {
+			total += b.Weight
+		}
+		n := int(h.Sum32() % uint32(total))
+		for _, b := range candidates {
+			if n < b.Weight {
+				return b
+			}
+			n -= b.Weight
+		}
+	}
+	// smooth weighted round-robin
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total := 0
+	var best *Backend
+	for _, b := range candidates {
+		b.current += b.Weight
+		total += b.Weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// report records the outcome of a request for passive ejection.
+func (p *Pool) report(b *Backend, failed bool) {
+	if p.EjectAfter == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= p.EjectAfter {
+		b.failures = 0
+		b.ejected = time.Now().Add(p.EjectTime)
+		fmt.Println("Reverse server: ejecting backend", b.URL.Host, "for", p.EjectTime)
+	}
+}
+
+// healthCheck polls every backend until ctx is done.
+func (p *Pool) healthCheck(ctx context.Context, transport http.RoundTripper) {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   p.CheckTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(p.CheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, b := range p.Backends {
+			go p.check(ctx, client, b)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) check(ctx context.Context, client *http.Client, b *Backend) {
+	u := *b.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + p.CheckPath
+	ok := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err == nil {
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			ok = resp.StatusCode < 400
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok != b.down {
+		b.checkRun = 0
+		return
+	}
+	b.checkRun++
+	if b.down && b.checkRun >= p.Rise {
+		b.down, b.checkRun = false, 0
+		fmt.Println("Reverse server: backend", b.URL.Host, "is up")
+	} else if !b.down && b.checkRun >= p.Fall {
+		b.down, b.checkRun = true, 0
+		fmt.Println("Reverse server: backend", b.URL.Host, "is down")
+	}
+}
+
+// balancer sends each proxied request to a backend of its route's pool,
+// retrying idempotent requests on another one.
+type balancer struct {
+	transport http.RoundTripper
+}
+
+func (t *balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := req.Context().Value(routeKey{}).(*Route)
+	p := rt.Pool
+	tried := make(map[*Backend]bool)
+	for attempt := 0; ; attempt++ {
+		b := p.pick(req, tried)
+		if b == nil {
+			return nil, errNoBackend
+		}
+		tried[b] = true
+		out := req.Clone(req.Context())
+		out.URL.Scheme = b.URL.Scheme
+		out.URL.Host = b.URL.Host
+		out.URL.Path = strings.TrimSuffix(b.URL.Path, "/") + req.URL.Path
+		if !rt.PreserveHost {
+			out.Host = b.URL.Host
+		}
+		// after httputil.ReverseProxy added X-Forwarded-For, so rules
+		// can change it too
+		rt.RequestHeaders.apply(out.Header)
+
+		atomic.AddInt64(&b.active, 1)
+		resp, err := t.transport.RoundTrip(out)
+		p.report(b, err != nil || resp.StatusCode >= 500)
+
+		retry := err != nil || resp.StatusCode == http.StatusBadGateway ||
+			resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		if !retry || attempt >= p.Retries || len(tried) == len(p.Backends) || !replayable(req) || req.Context().Err() != nil {
+			if err != nil {
+				atomic.AddInt64(&b.active, -1)
+				return nil, err
+			}
+			// the request is in flight until its body is read
+			resp.Body = &activeBody{ReadCloser: resp.Body, active: &b.active}
+			return resp, nil
+		}
+		atomic.AddInt64(&b.active, -1)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		fmt.Println("Reverse server: retrying", req.Method, req.URL.Path, "after backend", b.URL.Host, "failed")
+	}
+}
+
+type activeBody struct {
+	io.ReadCloser
+	active *int64
+	once   sync.Once
+}
+
+func (b *activeBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(b.active, -1) })
+	return b.ReadCloser.Close()
+}
+
+// replayable reports whether req may be sent again: it is idempotent and
+// has no body that was already consumed.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
@@ -0,0 +1,133 @@
+package reverse
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// namedBackend answers its name with the status in *status, 200 if zero.
+func namedBackend(t *testing.T, name string, status *int32, hits *int32) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		io.ReadAll(r.Body)
+		if code := atomic.LoadInt32(status); code != 0 {
+			w.WriteHeader(int(code))
+		}
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestBalanceWeights(t *testing.T) {
+	var status int32
+	hits := make([]int32, 3)
+	var list []string
+	for i := range hits {
+		b := namedBackend(t, fmt.Sprint(i), &status, &hits[i])
+		list = append(list, fmt.Sprintf("%s*%d", b.URL, i+1))
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		_, front := newFront(t, "route app.test "+strings.Join(list, ","))
+		for i := 0; i < 60; i++ {
+			resp := do(t, front, "GET", "app.test", "/")
+			io.ReadAll(resp.Body)
+		}
+		for i := range hits {
+			if n := atomic.SwapInt32(&hits[i], 0); n != int32(10*(i+1)) {
+				t.Errorf("backend %d got %d requests, want %d", i, n, 10*(i+1))
+			}
+		}
+	})
+
+	t.Run("ip-hash", func(t *testing.T) {
+		_, front := newFront(t, "route app.test "+strings.Join(list, ",")+" lb=ip-hash")
+		var first string
+		for i := 0; i < 10; i++ {
+			resp := do(t, front, "GET", "app.test", "/")
+			body, _ := io.ReadAll(resp.Body)
+			if i == 0 {
+				first = string(body)
+			} else if string(body) != first {
+				t.Fatalf("request %d went to %s, then %s", i, first, body)
+			}
+		}
+	})
+}
+
+func TestBalanceEject(t *testing.T) {
+	var badStatus, goodStatus, badHits, goodHits int32
+	atomic.StoreInt32(&badStatus, http.StatusInternalServerError)
+	bad := namedBackend(t, "bad", &badStatus, &badHits)
+	good := namedBackend(t, "good", &goodStatus, &goodHits)
+	_, front := newFront(t, "route app.test "+bad.URL+","+good.URL+" eject=2 eject-time=300ms retries=0")
+
+	get := func() {
+		resp := do(t, front, "GET", "app.test", "/")
+		io.ReadAll(resp.Body)
+	}
+	// round-robin alternates until the second 500 ejects bad
+	for i := 0; i < 10; i++ {
+		get()
+	}
+	if n := atomic.LoadInt32(&badHits); n != 2 {
+		t.Errorf("bad backend got %d requests before ejection, want 2", n)
+	}
+	if n := atomic.LoadInt32(&goodHits); n != 8 {
+		t.Errorf("good backend got %d requests, want 8", n)
+	}
+
+	atomic.StoreInt32(&badStatus, 0)
+	time.Sleep(400 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if n := atomic.LoadInt32(&badHits); n < 3 {
+		t.Errorf("bad backend got no requests after eject-time")
+	}
+}
+
+func TestBalanceRetry(t *testing.T) {
+	for _, method := range []string{"GET", "POST"} {
+		t.Run(method, func(t *testing.T) {
+			var badStatus, goodStatus, badHits, goodHits int32
+			atomic.StoreInt32(&badStatus, http.StatusBadGateway)
+			bad := namedBackend(t, "bad", &badStatus, &badHits)
+			good := namedBackend(t, "good", &goodStatus, &goodHits)
+			// the first pick of a fresh pool is its first backend
+			_, front := newFront(t, "route app.test "+bad.URL+","+good.URL+" eject=0")
+
+			var body io.Reader
+			if method == "POST" {
+				body = strings.NewReader("body")
+			}
+			req, err := http.NewRequest(method, front.URL+"/", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "app.test"
+			resp, err := front.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			answer, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			want, wantGood := "good", int32(1)
+			if method == "POST" {
+				want, wantGood = "bad", 0
+			}
+			if string(answer) != want || atomic.LoadInt32(&badHits) != 1 || atomic.LoadInt32(&goodHits) != wantGood {
+				t.Errorf("answer %q from bad %d times and good %d times", answer, badHits, goodHits)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package reverse
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key types for CreateCA and issued certificates.
+const (
+	KeyECDSA = "ecdsa"
+	KeyRSA   = "rsa"
+)
+
+// DefaultLeafValidity is how long issued certificates are valid.
+const DefaultLeafValidity = 90 * 24 * time.Hour
+
+// CreateCA writes a new self-signed CA certificate and key to certPath
+// and keyPath. It does not overwrite existing files.
+func CreateCA(certPath, keyPath, keyType string, validity time.Duration) error {
+	for _, name := range []string{certPath, keyPath} {
+		if _, err := os.Stat(name); err == nil {
+			return errors.New(name + " already exists")
+		}
+	}
+	key, err := generateKey(keyType)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "proxy development CA " + host,
+			Organization: []string{"proxy development CA"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          keyID(key.Public()),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return nil, errors.New("unknown key type " + keyType)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func keyID(pub crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	sum := sha1.Sum(der)
+	return sum[:]
+}
+
+// issuer mints certificates signed by a CA for the hosts the reverse
+// server routes. In reverseList.db it reads
+//
+//	ca <ca.pem> <ca-key.pem> [validity=2160h] [key=ecdsa|rsa]
+//	   [names=a.test,*.b.test] [max-certs=1000]
+//
+// Certificates are issued for the hosts of routes other than "*" and for
+// the names listed, which may be wildcards. The last max-certs issued are
+// kept in memory and renewed when a third of their validity is left.
+type issuer struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	keyType  string
+	validity time.Duration
+	names    []string
+
+	mu    sync.Mutex // guards cache and order, not the entries
+	cache map[string]*issuedCert
+	order *lru
+}
+
+// DefaultMaxCerts is how many issued certificates are kept by default.
+const DefaultMaxCerts = 1000
+
+// issuedCert is locked while its certificate is issued, so handshakes for
+// other names do not wait on key generation.
+type issuedCert struct {
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+func parseIssuer(words []string) (*issuer, error) {
+	if len(words) < 2 {
+		return nil, errors.New("ca needs a certificate and a key")
+	}
+	pair, err := tls.LoadX509KeyPair(words[0], words[1])
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !cert.IsCA || !ok {
+		return nil, errors.New(words[0] + " is not a CA certificate")
+	}
+	is := &issuer{
+		cert:     cert,
+		key:      key,
+		keyType:  KeyECDSA,
+		validity: DefaultLeafValidity,
+		cache:    make(map[string]*issuedCert),
+	}
+	max := int64(DefaultMaxCerts)
+	for _, word := range words[2:] {
+		k, v, _ := strings.Cut(word, "=")
+		switch k {
+		case "validity":
+			is.validity, err = time.ParseDuration(v)
+			if err != nil || is.validity <= 0 {
+				return nil, errors.New("invalid validity " + v)
+			}
+		case "key":
+			if v != KeyECDSA && v != KeyRSA {
+				return nil, errors.New("unknown key type " + v)
+			}
+			is.keyType = v
+		case "names":
+			for _, name := range strings.Split(strings.ToLower(v), ",") {
+				if name == "" || name == "*" {
+					return nil, errors.New("invalid ca name \"" + name + "\"")
+				}
+				is.names = append(is.names, name)
+			}
+		case "max-certs":
+			max, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || max < 1 {
+				return nil, errors.New("invalid max-certs " + v)
+			}
+		default:
+			return nil, errors.New("unknown ca key " + k)
+		}
+	}
+	// each certificate counts as one
+	is.order = newLRU(max, func(name string) { delete(is.cache, name) })
+	return is, nil
+}
+
+// get returns a certificate for name, which may be a wildcard.
+func (is *issuer) get(name string) (*tls.Certificate, error) {
+	is.mu.Lock()
+	e, ok := is.cache[name]
+	if ok {
+		is.order.touch(name)
+	} else {
+		e = &issuedCert{}
+		is.cache[name] = e
+		is.order.add(&lruItem{key: name, size: 1})
+	}
+	is.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if e.cert != nil {
+		// the CA may cut the validity short
+		leaf := e.cert.Leaf
+		if now.Before(leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 3)) {
+			return e.cert, nil
+		}
+	}
+	cert, err := is.issue(name, now)
+	if err != nil {
+		return nil, err
+	}
+	e.cert = cert
+	return cert, nil
+}
+
+func (is *issuer) issue(name string, now time.Time) (*tls.Certificate, error) {
+	key, err := generateKey(is.keyType)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	notAfter := now.Add(is.validity)
+	if notAfter.After(is.cert.NotAfter) {
+		notAfter = is.cert.NotAfter
+	}
+	usage := x509.KeyUsageDigitalSignature
+	if is.keyType == KeyRSA {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"proxy development certificate"}},
+		DNSNames:              []string{name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              usage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		AuthorityKeyId:        is.cert.SubjectKeyId,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, is.cert, key.Public(), is.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, is.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// issueName returns the name to issue a certificate for to serve
+// serverName: the wildcard of the route or listed name matching it if that
+// covers it, otherwise serverName itself if any of them matches it. A "*"
+// route matches nothing here, or any name a client sends would get one.
+func (r *ReverseServer) issueName(serverName string) (string, bool) {
+	if serverName == "" {
+		return "", false
+	}
+	hosts := append([]string(nil), r.issuer.names...)
+	for _, rt := range r.routes {
+		hosts = append(hosts, rt.Host)
+	}
+	name, ok := "", false
+	for _, host := range hosts {
+		if host == "*" || !matchHost(host, serverName) {
+			continue
+		}
+		// a wildcard certificate covers a single label
+		label := strings.TrimSuffix(serverName, host[1:])
+		if strings.HasPrefix(host, "*.") && !strings.Contains(label, ".") {
+			return host, true
+		}
+		name, ok = serverName, true
+	}
+	return name, ok
+}
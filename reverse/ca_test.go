@@ -0,0 +1,140 @@
+package reverse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIssuerConcurrent(t *testing.T) {
+	is := testIssuer(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(is.cert)
+
+	names := []string{"a.test", "b.test", "*.c.test"}
+	certs := make([][]*tls.Certificate, len(names))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, name := range names {
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(i int, name string) {
+				defer wg.Done()
+				cert, err := is.get(name)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				certs[i] = append(certs[i], cert)
+				mu.Unlock()
+			}(i, name)
+		}
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		for _, cert := range certs[i] {
+			if cert != certs[i][0] {
+				t.Errorf("%s: issued more than once", name)
+			}
+		}
+		host := name
+		if host[0] == '*' {
+			host = "x" + host[1:]
+		}
+		_, err := certs[i][0].Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func testIssuer(t *testing.T, keys ...string) *issuer {
+	t.Helper()
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	if err := CreateCA(certPath, keyPath, KeyECDSA, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	is, err := parseIssuer(append([]string{certPath, keyPath}, keys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return is
+}
+
+func TestIssuerEvict(t *testing.T) {
+	is := testIssuer(t, "max-certs=2")
+	a, err := is.get("a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b.test", "c.test"} {
+		if _, err := is.get(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(is.cache) != 2 {
+		t.Errorf("%d certificates kept, want 2", len(is.cache))
+	}
+	if _, ok := is.cache["a.test"]; ok {
+		t.Error("least recently used certificate kept")
+	}
+	if again, _ := is.get("a.test"); again == a {
+		t.Error("evicted certificate served again")
+	}
+	// c.test was used last, b.test goes
+	is.get("c.test")
+	is.get("d.test")
+	if _, ok := is.cache["b.test"]; ok {
+		t.Error("b.test kept after d.test was issued")
+	}
+
+	for _, key := range []string{"max-certs=0", "max-certs=x", "names=*", "names=a.test,,b.test"} {
+		dir := t.TempDir()
+		certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+		CreateCA(certPath, keyPath, KeyECDSA, time.Hour)
+		if _, err := parseIssuer([]string{certPath, keyPath, key}); err == nil {
+			t.Errorf("%s parsed", key)
+		}
+	}
+}
+
+func TestIssueName(t *testing.T) {
+	r := newList(t, "route * 127.0.0.1:1\nroute *.a.test 127.0.0.1:2\nroute b.test 127.0.0.1:3")
+	r.issuer = testIssuer(t, "names=c.test,*.d.test")
+
+	tests := []struct {
+		serverName string
+		name       string
+		ok         bool
+	}{
+		{"b.test", "b.test", true},
+		{"x.a.test", "*.a.test", true},
+		// a wildcard covers one label only
+		{"x.y.a.test", "x.y.a.test", true},
+		{"c.test", "c.test", true},
+		{"x.d.test", "*.d.test", true},
+		// only the "*" route matches
+		{"evil.test", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		name, ok := r.issueName(tt.serverName)
+		if name != tt.name || ok != tt.ok {
+			t.Errorf("issueName(%q) = %q, %v, want %q, %v", tt.serverName, name, ok, tt.name, tt.ok)
+		}
+	}
+
+	// the "*" route has no certificate to fall back on either
+	if _, err := r.getCertificate(&tls.ClientHelloInfo{ServerName: "evil.test"}); err == nil {
+		t.Error("evil.test got a certificate")
+	}
+	if len(r.issuer.cache) != 0 {
+		t.Errorf("%d certificates issued", len(r.issuer.cache))
+	}
+}
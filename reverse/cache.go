@@ -0,0 +1,468 @@
+package reverse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStatusHeader tells whether a response came from the cache:
+//
+//	HIT          served from the cache
+//	REVALIDATED  served from the cache after the backend answered 304
+//	MISS         not in the cache, fetched from the backend
+//	EXPIRED      in the cache but stale, fetched again
+//	BYPASS       the request may not be served from the cache
+const CacheStatusHeader = "X-Cache-Status"
+
+// Cache keeps responses of the routes that set cache=true. In
+// reverseList.db it reads
+//
+//	cache <memory|dir> [size=256MB] [max-object=32MB]
+//
+// where a directory keeps responses on disk across restarts. Once size is
+// reached the least recently used responses are evicted; bodies over
+// max-object are not kept.
+//
+// Responses to GET are kept when Cache-Control allows a shared cache to
+// store them and they either give a lifetime with s-maxage, max-age or
+// Expires or can be revalidated with ETag or Last-Modified. There is no
+// heuristic lifetime, so a response without one is revalidated on every
+// request. Requests with Authorization, Range or Cache-Control: no-store
+// bypass the cache, and Vary is honored.
+type Cache struct {
+	MaxObject int64
+
+	store cacheStore
+}
+
+const (
+	defaultCacheSize = 256 << 20
+	defaultMaxObject = 32 << 20
+)
+
+func parseCache(words []string) (*Cache, error) {
+	if len(words) < 1 {
+		return nil, errors.New("cache needs \"memory\" or a directory")
+	}
+	size, maxObject := int64(defaultCacheSize), int64(defaultMaxObject)
+	for _, word := range words[1:] {
+		k, v, _ := strings.Cut(word, "=")
+		n, err := parseSize(v)
+		if err != nil {
+			return nil, err
+		}
+		switch k {
+		case "size":
+			size = n
+		case "max-object":
+			maxObject = n
+		default:
+			return nil, errors.New("unknown cache key " + k)
+		}
+	}
+	if maxObject > size {
+		maxObject = size
+	}
+	c := &Cache{MaxObject: maxObject}
+	if words[0] == "memory" {
+		c.store = newMemoryStore(size)
+		return c, nil
+	}
+	store, err := newDiskStore(words[0], size)
+	if err != nil {
+		return nil, err
+	}
+	c.store = store
+	return c, nil
+}
+
+// parseSize reads a byte count with an optional KB, MB or GB suffix.
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	num := strings.ToUpper(s)
+	for _, u := range []struct {
+		suffix string
+		n      int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(num, u.suffix) {
+			num, unit = strings.TrimSuffix(num, u.suffix), u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid size " + s)
+	}
+	return n * unit, nil
+}
+
+// cacheEntry is a stored response. An entry with Vary set only records
+// the headers the responses for its key vary on, which are kept under
+// keys including their values.
+type cacheEntry struct {
+	Status     int
+	Header     http.Header
+	Body       []byte
+	Stored     time.Time // when the response was received or revalidated
+	InitialAge time.Duration
+	Vary       []string
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.Body))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.Stored)
+}
+
+// lifetime returns how long the entry is fresh after it was created.
+func (e *cacheEntry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	for _, key := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[key]; ok {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || secs < 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(e.Header.Get("Date"))
+		if err != nil {
+			date = e.Stored
+		}
+		if d := exp.Sub(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func (e *cacheEntry) revalidatable() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// parseCacheControl returns the directives of the Cache-Control headers
+// of h, lowercased, with their values unquoted.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if k != "" {
+				cc[strings.ToLower(k)] = strings.Trim(v, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// cacheTransport answers the requests of caching routes from their cache
+// where it can and fills the cache with what next returns.
+type cacheTransport struct {
+	next http.RoundTripper
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := req.Context().Value(routeKey{}).(*Route).cache
+	if c == nil {
+		return t.next.RoundTrip(req)
+	}
+	if !cacheableRequest(req) {
+		return withStatus(t.next.RoundTrip(req))("BYPASS")
+	}
+	key := req.Host + req.URL.RequestURI()
+	e, varyKey := c.lookup(key, req.Header)
+	if e == nil {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil {
+			c.keep(req, resp, key, time.Now())
+		}
+		return withStatus(resp, err)("MISS")
+	}
+
+	now := time.Now()
+	cc := parseCacheControl(req.Header)
+	_, noCache := cc["no-cache"]
+	if req.Header.Get("Pragma") == "no-cache" || cc["max-age"] == "0" {
+		noCache = true
+	}
+	if !noCache && e.age(now) < e.lifetime() {
+		return e.response(req, now, "HIT"), nil
+	}
+	if !e.revalidatable() {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil {
+			c.keep(req, resp, key, time.Now())
+		}
+		return withStatus(resp, err)("EXPIRED")
+	}
+
+	// ask the backend with the entry's validators instead of the
+	// client's, which are checked against the entry afterwards
+	cond := req.Clone(req.Context())
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		cond.Header.Del(h)
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		cond.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		cond.Header.Set("If-Modified-Since", lm)
+	}
+	resp, err := t.next.RoundTrip(cond)
+	if err != nil {
+		return nil, err
+	}
+	now = time.Now()
+	if resp.StatusCode != http.StatusNotModified {
+		c.keep(req, resp, key, now)
+		return withStatus(resp, nil)("EXPIRED")
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	e = e.revalidated(resp.Header, now)
+	c.store.put(varyKey, e)
+	return e.response(req, now, "REVALIDATED"), nil
+}
+
+func withStatus(resp *http.Response, err error) func(string) (*http.Response, error) {
+	return func(status string) (*http.Response, error) {
+		if err == nil {
+			resp.Header.Set(CacheStatusHeader, status)
+		}
+		return resp, err
+	}
+}
+
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// lookup returns the entry for key matching the headers h, and the key it
+// is stored under.
+func (c *Cache) lookup(key string, h http.Header) (*cacheEntry, string) {
+	e, ok := c.store.get(key)
+	if !ok {
+		return nil, key
+	}
+	if e.Vary != nil {
+		key = varyKey(key, e.Vary, h)
+		if e, ok = c.store.get(key); !ok || e.Vary != nil {
+			return nil, key
+		}
+	}
+	return e, key
+}
+
+func varyKey(key string, names []string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range names {
+		b.WriteString("\n" + name + ":" + strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
+
+// cacheableStatus lists the statuses kept.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// hopHeaders are not kept with a response.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", CacheStatusHeader,
+}
+
+// keep arranges for resp to be stored under key once its body was read,
+// if it may be. A response that may not be stored still replaces what was
+// stored under key, so an older one is not served in its place.
+func (c *Cache) keep(req *http.Request, resp *http.Response, key string, now time.Time) {
+	if req.Method != http.MethodGet || !cacheableStatus[resp.StatusCode] {
+		return
+	}
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		c.store.remove(key)
+		return
+	}
+	if _, ok := cc["private"]; ok {
+		c.store.remove(key)
+		return
+	}
+	if resp.Header.Get("Set-Cookie") != "" || resp.ContentLength > c.MaxObject {
+		c.store.remove(key)
+		return
+	}
+	var vary []string
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				c.store.remove(key)
+				return
+			}
+			if name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+	sort.Strings(vary)
+	e := &cacheEntry{Status: resp.StatusCode, Header: resp.Header.Clone(), Stored: now}
+	for _, h := range hopHeaders {
+		e.Header.Del(h)
+	}
+	if age, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		e.InitialAge = time.Duration(age) * time.Second
+	}
+	if e.lifetime() == 0 && !e.revalidatable() {
+		c.store.remove(key)
+		return
+	}
+	resp.Body = &cacheBody{ReadCloser: resp.Body, max: c.MaxObject, over: func() {
+		c.store.remove(key)
+	}, done: func(body []byte) {
+		e.Body = body
+		if len(vary) > 0 {
+			c.store.put(key, &cacheEntry{Vary: vary})
+			key = varyKey(key, vary, req.Header)
+		}
+		c.store.put(key, e)
+	}}
+}
+
+// revalidated returns a copy of e refreshed by the headers of a 304.
+func (e *cacheEntry) revalidated(h http.Header, now time.Time) *cacheEntry {
+	fresh := *e
+	fresh.Header = e.Header.Clone()
+	for k, v := range h {
+		if k == "Content-Length" || k == CacheStatusHeader {
+			continue
+		}
+		fresh.Header[k] = v
+	}
+	for _, k := range hopHeaders {
+		fresh.Header.Del(k)
+	}
+	fresh.Stored = now
+	fresh.InitialAge = 0
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		fresh.InitialAge = time.Duration(age) * time.Second
+	}
+	return &fresh
+}
+
+// response builds the answer to req from e, a 304 if the client's own
+// validators match it.
+func (e *cacheEntry) response(req *http.Request, now time.Time, status string) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Set(CacheStatusHeader, status)
+	code, body := e.Status, e.Body
+	if notModified(req, e.Header) {
+		code, body = http.StatusNotModified, nil
+		h.Del("Content-Length")
+	} else {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func notModified(req *http.Request, h http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// cacheBody passes a response body through, handing it to done once it
+// was read to the end, or calling over once it grew over max.
+type cacheBody struct {
+	io.ReadCloser
+	max  int64
+	done func([]byte)
+	over func()
+	buf  bytes.Buffer
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done != nil {
+		b.buf.Write(p[:n])
+		if int64(b.buf.Len()) > b.max {
+			b.over()
+			b.done = nil
+			b.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,315 @@
+package reverse
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheBackend serves the paths the cache tests use and counts the
+// requests for each.
+type cacheBackend struct {
+	*httptest.Server
+	version  int32 // of the /etag and /lm responses
+	growSize int32 // of the /grow body
+
+	mu   sync.Mutex
+	hits map[string]int
+	// validators of the last conditional request
+	conds []string
+}
+
+func newCacheBackend(t *testing.T) *cacheBackend {
+	t.Helper()
+	b := &cacheBackend{hits: make(map[string]int), growSize: 10}
+	lastModified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		b.hits[r.URL.Path]++
+		n := b.hits[r.URL.Path]
+		b.conds = []string{r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")}
+		b.mu.Unlock()
+		version := atomic.LoadInt32(&b.version)
+
+		h := w.Header()
+		switch {
+		case r.URL.Path == "/fresh":
+			h.Set("Cache-Control", "max-age=60")
+			fmt.Fprintf(w, "fresh %d", n)
+		case r.URL.Path == "/etag":
+			etag := fmt.Sprintf(`"v%d"`, version)
+			h.Set("Cache-Control", "no-cache")
+			h.Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprintf(w, "etag v%d", version)
+		case r.URL.Path == "/lm":
+			modified := lastModified.Add(time.Duration(version) * time.Hour)
+			h.Set("Cache-Control", "no-cache")
+			h.Set("Last-Modified", modified.Format(http.TimeFormat))
+			if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprintf(w, "lm v%d", version)
+		case r.URL.Path == "/vary":
+			h.Set("Cache-Control", "max-age=60")
+			h.Set("Vary", "Accept-Language")
+			fmt.Fprintf(w, "%s %d", r.Header.Get("Accept-Language"), n)
+		case strings.HasPrefix(r.URL.Path, "/big/"):
+			h.Set("Cache-Control", "max-age=60")
+			fmt.Fprintf(w, "%d %s", n, strings.Repeat("x", 1000))
+		case r.URL.Path == "/grow":
+			h.Set("Cache-Control", "max-age=60")
+			fmt.Fprintf(w, "%d %s", n, strings.Repeat("x", int(atomic.LoadInt32(&b.growSize))))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *cacheBackend) count(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hits[path]
+}
+
+// cacheGet sends a GET for path with header through front and returns the
+// cache status and the start of the body.
+func cacheGet(t *testing.T, front *httptest.Server, path string, header ...string) (int, string, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", front.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.test"
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := front.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if len(body) > 20 {
+		body = body[:20]
+	}
+	return resp.StatusCode, resp.Header.Get(CacheStatusHeader), string(body)
+}
+
+// cacheStores runs test against a memory and a disk cache of size bytes.
+func cacheStores(t *testing.T, size int, test func(t *testing.T, cacheLine string)) {
+	for _, store := range []string{"memory", "disk"} {
+		t.Run(store, func(t *testing.T) {
+			where := store
+			if store == "disk" {
+				where = filepath.Join(t.TempDir(), "cache")
+			}
+			test(t, "cache "+where+" size="+strconv.Itoa(size)+"B")
+		})
+	}
+}
+
+type cacheStep struct {
+	path   string
+	header []string
+	code   int
+	status string
+	body   string
+}
+
+func runSteps(t *testing.T, front *httptest.Server, steps []cacheStep) {
+	t.Helper()
+	for i, s := range steps {
+		code, status, body := cacheGet(t, front, s.path, s.header...)
+		if code != s.code || status != s.status || !strings.HasPrefix(body, s.body) {
+			t.Errorf("step %d %s %v: %d %s %q, want %d %s %q", i, s.path, s.header, code, status, body, s.code, s.status, s.body)
+		}
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	cacheStores(t, 1<<20, func(t *testing.T, cacheLine string) {
+		b := newCacheBackend(t)
+		_, front := newFront(t, cacheLine+"\nroute app.test "+b.URL+" cache=true")
+		runSteps(t, front, []cacheStep{
+			{"/fresh", nil, 200, "MISS", "fresh 1"},
+			{"/fresh", nil, 200, "HIT", "fresh 1"},
+			{"/fresh", []string{"Authorization", "Basic eDp4"}, 200, "BYPASS", "fresh 2"},
+			{"/fresh", []string{"Cache-Control", "no-store"}, 200, "BYPASS", "fresh 3"},
+			{"/fresh", []string{"Range", "bytes=0-1"}, 200, "BYPASS", "fresh 4"},
+			// what bypassed did not replace the entry
+			{"/fresh", nil, 200, "HIT", "fresh 1"},
+			// not revalidatable, so fetched again
+			{"/fresh", []string{"Cache-Control", "no-cache"}, 200, "EXPIRED", "fresh 5"},
+			{"/fresh", nil, 200, "HIT", "fresh 5"},
+			{"/missing", nil, 404, "MISS", ""},
+		})
+		if n := b.count("/fresh"); n != 5 {
+			t.Errorf("backend got %d requests for /fresh, want 5", n)
+		}
+	})
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	cacheStores(t, 1<<20, func(t *testing.T, cacheLine string) {
+		b := newCacheBackend(t)
+		_, front := newFront(t, cacheLine+"\nroute app.test "+b.URL+" cache=true")
+		runSteps(t, front, []cacheStep{
+			{"/etag", nil, 200, "MISS", "etag v0"},
+			{"/etag", nil, 200, "REVALIDATED", "etag v0"},
+			// the client's validator is checked against the entry
+			{"/etag", []string{"If-None-Match", `"v0"`}, 304, "REVALIDATED", ""},
+			{"/etag", []string{"If-None-Match", `"other"`}, 200, "REVALIDATED", "etag v0"},
+			{"/lm", nil, 200, "MISS", "lm v0"},
+			{"/lm", nil, 200, "REVALIDATED", "lm v0"},
+			{"/lm", []string{"If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT"}, 304, "REVALIDATED", ""},
+		})
+		b.mu.Lock()
+		conds := b.conds
+		b.mu.Unlock()
+		if conds[0] != "" || conds[1] != "Mon, 01 Jan 2024 00:00:00 GMT" {
+			t.Errorf("backend got validators %q", conds)
+		}
+
+		atomic.StoreInt32(&b.version, 1)
+		runSteps(t, front, []cacheStep{
+			{"/etag", nil, 200, "EXPIRED", "etag v1"},
+			{"/etag", nil, 200, "REVALIDATED", "etag v1"},
+			{"/lm", nil, 200, "EXPIRED", "lm v1"},
+			{"/lm", nil, 200, "REVALIDATED", "lm v1"},
+		})
+	})
+}
+
+func TestCacheVary(t *testing.T) {
+	cacheStores(t, 1<<20, func(t *testing.T, cacheLine string) {
+		b := newCacheBackend(t)
+		_, front := newFront(t, cacheLine+"\nroute app.test "+b.URL+" cache=true")
+		runSteps(t, front, []cacheStep{
+			{"/vary", []string{"Accept-Language", "en"}, 200, "MISS", "en 1"},
+			{"/vary", []string{"Accept-Language", "fr"}, 200, "MISS", "fr 2"},
+			{"/vary", []string{"Accept-Language", "en"}, 200, "HIT", "en 1"},
+			{"/vary", []string{"Accept-Language", "fr"}, 200, "HIT", "fr 2"},
+			{"/vary", nil, 200, "MISS", " 3"},
+		})
+	})
+}
+
+func TestCacheEvict(t *testing.T) {
+	// room for two of the /big responses but not three
+	cacheStores(t, 3000, func(t *testing.T, cacheLine string) {
+		b := newCacheBackend(t)
+		_, front := newFront(t, cacheLine+"\nroute app.test "+b.URL+" cache=true")
+		runSteps(t, front, []cacheStep{
+			{"/big/1", nil, 200, "MISS", "1 x"},
+			{"/big/2", nil, 200, "MISS", "1 x"},
+			{"/big/1", nil, 200, "HIT", "1 x"},
+			// /big/2 was used least recently
+			{"/big/3", nil, 200, "MISS", "1 x"},
+			{"/big/1", nil, 200, "HIT", "1 x"},
+			{"/big/2", nil, 200, "MISS", "2 x"},
+		})
+	})
+}
+
+func TestCacheReplaceTooBig(t *testing.T) {
+	cacheStores(t, 3000, func(t *testing.T, cacheLine string) {
+		b := newCacheBackend(t)
+		_, front := newFront(t, cacheLine+"\nroute app.test "+b.URL+" cache=true")
+		runSteps(t, front, []cacheStep{
+			{"/grow", nil, 200, "MISS", "1 x"},
+			{"/grow", nil, 200, "HIT", "1 x"},
+		})
+		// a body that fits max-object, but not with its headers
+		atomic.StoreInt32(&b.growSize, 2950)
+		runSteps(t, front, []cacheStep{
+			{"/grow", []string{"Cache-Control", "no-cache"}, 200, "EXPIRED", "2 x"},
+			{"/grow", nil, 200, "MISS", "3 x"},
+		})
+		// a body over max-object
+		atomic.StoreInt32(&b.growSize, 10)
+		runSteps(t, front, []cacheStep{{"/grow", nil, 200, "MISS", "4 x"}})
+		atomic.StoreInt32(&b.growSize, 5000)
+		runSteps(t, front, []cacheStep{
+			{"/grow", []string{"Cache-Control", "no-cache"}, 200, "EXPIRED", "5 x"},
+			{"/grow", nil, 200, "MISS", "6 x"},
+		})
+	})
+}
+
+func TestCacheDiskTakeOver(t *testing.T) {
+	b := newCacheBackend(t)
+	dir := filepath.Join(t.TempDir(), "cache")
+	_, front := newFront(t, "cache "+dir+"\nroute app.test "+b.URL+" cache=true")
+	runSteps(t, front, []cacheStep{
+		{"/big/1", nil, 200, "MISS", "1 x"},
+		{"/big/2", nil, 200, "MISS", "1 x"},
+		{"/fresh", nil, 200, "MISS", "fresh 1"},
+	})
+	front.Close()
+	// file times may be too coarse to tell the writes apart
+	for i, path := range []string{"/big/1", "/big/2", "/fresh"} {
+		name := filepath.Join(dir, (&diskStore{}).fileName("app.test"+path))
+		at := time.Now().Add(time.Duration(i-3) * time.Minute)
+		if err := os.Chtimes(name, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restart finds the files
+	_, front = newFront(t, "cache "+dir+"\nroute app.test "+b.URL+" cache=true")
+	runSteps(t, front, []cacheStep{
+		{"/fresh", nil, 200, "HIT", "fresh 1"},
+		{"/big/1", nil, 200, "HIT", "1 x"},
+	})
+	front.Close()
+
+	// a smaller cache keeps the newest files; /big/1 was read, not written
+	_, front = newFront(t, "cache "+dir+" size=2000B\nroute app.test "+b.URL+" cache=true")
+	runSteps(t, front, []cacheStep{
+		{"/fresh", nil, 200, "HIT", "fresh 1"},
+		{"/big/1", nil, 200, "MISS", "2 x"},
+	})
+	if n := b.count("/big/2"); n != 1 {
+		t.Errorf("backend got %d requests for /big/2", n)
+	}
+}
+
+func TestLRUReplace(t *testing.T) {
+	var evicted []string
+	l := newLRU(10, func(key string) { evicted = append(evicted, key) })
+	l.add(&lruItem{key: "a", size: 4})
+	l.add(&lruItem{key: "b", size: 4})
+	// a replacement too big for the store leaves nothing behind
+	if l.add(&lruItem{key: "a", size: 11}) {
+		t.Error("item bigger than the store added")
+	}
+	if _, ok := l.items["a"]; ok || l.size != 4 {
+		t.Errorf("after a refused replacement: items %v, size %d", l.items, l.size)
+	}
+	// replacing b does not evict it, c then evicts nothing
+	l.add(&lruItem{key: "b", size: 6})
+	l.add(&lruItem{key: "c", size: 4})
+	if l.size != 10 || len(evicted) != 0 {
+		t.Errorf("size %d, evicted %v", l.size, evicted)
+	}
+	l.add(&lruItem{key: "d", size: 1})
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("evicted %v, want [b]", evicted)
+	}
+}
@@ -0,0 +1,168 @@
+package reverse
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Header rule operations.
+const (
+	HeaderAdd = "add"
+	HeaderSet = "set"
+	HeaderDel = "del"
+)
+
+// HeaderRule changes a header of the requests or responses of a route.
+// Route lines give them as req-add=Name:Value, req-set=Name:Value and
+// req-del=Name, and likewise resp-add, resp-set and resp-del.
+type HeaderRule struct {
+	Op    string
+	Name  string
+	Value string
+}
+
+type HeaderRules []HeaderRule
+
+func parseHeaderRule(op, value string) (HeaderRule, error) {
+	name, v, ok := strings.Cut(value, ":")
+	if name == "" {
+		return HeaderRule{}, errors.New("header rule needs a name")
+	}
+	if op == HeaderDel && ok {
+		return HeaderRule{}, errors.New("header del takes no value: " + value)
+	}
+	if op != HeaderDel && !ok {
+		return HeaderRule{}, errors.New("header " + op + " needs Name:Value, got " + value)
+	}
+	return HeaderRule{Op: op, Name: http.CanonicalHeaderKey(name), Value: v}, nil
+}
+
+// apply runs the rules on h in order.
+func (rules HeaderRules) apply(h http.Header) {
+	for _, rule := range rules {
+		switch rule.Op {
+		case HeaderAdd:
+			h.Add(rule.Name, rule.Value)
+		case HeaderSet:
+			h.Set(rule.Name, rule.Value)
+		case HeaderDel:
+			h.Del(rule.Name)
+		}
+	}
+}
+
+// parseTrust parses the words after "trust": the addresses or CIDRs of
+// proxies in front of the reverse server whose X-Forwarded-* and
+// Forwarded headers are passed on. In reverseList.db it reads
+//
+//	trust <ip|cidr> ...
+//
+// and may be repeated. Other clients' forwarding headers are dropped.
+func parseTrust(words []string) ([]*net.IPNet, error) {
+	if len(words) == 0 {
+		return nil, errors.New("trust needs addresses")
+	}
+	var nets []*net.IPNet
+	for _, word := range words {
+		if ip := net.ParseIP(word); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(word)
+		if err != nil {
+			return nil, errors.New("invalid trust address " + word)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trusts reports whether the client at remoteAddr is a trusted proxy.
+func trusts(trusted []*net.IPNet, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range trusted {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardHeaders tells the backend about the client of req with the
+// X-Forwarded-Proto, X-Forwarded-Host and RFC 7239 Forwarded headers.
+// X-Forwarded-For is appended to by httputil.ReverseProxy itself. The
+// forwarding headers of a trusted client are kept, those of others are
+// dropped first so they cannot make up a chain.
+func forwardHeaders(req *http.Request, trusted bool) {
+	if !trusted {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			req.Header.Del(name)
+		}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	elem := "proto=" + proto
+	if req.Host != "" {
+		elem = "host=" + forwardedValue(req.Host) + ";" + elem
+	}
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		elem = "for=" + forwardedValue(ip) + ";" + elem
+	}
+	if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	req.Header.Set("Forwarded", elem)
+}
+
+// appendForwardedFor adds the client address of req to X-Forwarded-For,
+// as httputil.ReverseProxy does for the requests it sends. forwardHeaders
+// must have run first.
+func appendForwardedFor(req *http.Request) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return
+	}
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+}
+
+// forwardedValue quotes v for a Forwarded header unless it is a token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,172 @@
+package reverse
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// headerBackend answers the request headers and Host it got as JSON and
+// sets X-Powered-By and X-Resp for response rules to work on.
+func headerBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Clone()
+		h.Set("Host", r.Host)
+		w.Header().Set("X-Powered-By", "test")
+		w.Header().Set("X-Resp", "0")
+		json.NewEncoder(w).Encode(h)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// sentHeaders sends req through front and returns the headers the
+// backend got and the response.
+func sentHeaders(t *testing.T, front *httptest.Server, header http.Header) (http.Header, *http.Response) {
+	t.Helper()
+	req, err := http.NewRequest("GET", front.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.test"
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := front.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got http.Header
+	if err = json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	return got, resp
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	backend := headerBackend(t)
+	// what a proxy in front of us, or a client making it up, sends
+	chain := http.Header{
+		"X-Forwarded-For":   {"203.0.113.7"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"public.test"},
+		"Forwarded":         {"for=203.0.113.7;host=public.test;proto=https"},
+	}
+	tests := []struct {
+		name  string
+		trust string
+		sent  http.Header
+		want  http.Header
+	}{
+		{"no chain", "", nil, http.Header{
+			"X-Forwarded-For":   {"127.0.0.1"},
+			"X-Forwarded-Proto": {"http"},
+			"X-Forwarded-Host":  {"app.test"},
+			"Forwarded":         {"for=127.0.0.1;host=app.test;proto=http"},
+		}},
+		{"untrusted", "trust 10.0.0.0/8 ::1", chain, http.Header{
+			"X-Forwarded-For":   {"127.0.0.1"},
+			"X-Forwarded-Proto": {"http"},
+			"X-Forwarded-Host":  {"app.test"},
+			"Forwarded":         {"for=127.0.0.1;host=app.test;proto=http"},
+		}},
+		{"trusted", "trust 10.0.0.0/8 127.0.0.1", chain, http.Header{
+			"X-Forwarded-For":   {"203.0.113.7, 127.0.0.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"public.test"},
+			"Forwarded":         {"for=203.0.113.7;host=public.test;proto=https, for=127.0.0.1;host=app.test;proto=http"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, front := newFront(t, tt.trust+"\nroute app.test "+backend.URL)
+			got, _ := sentHeaders(t, front, tt.sent)
+			for name, want := range tt.want {
+				if !reflect.DeepEqual(got[name], want) {
+					t.Errorf("%s: %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardHeadersQuoting(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://a.test:8080/", nil)
+	req.RemoteAddr = "[2001:db8::1]:1234"
+	forwardHeaders(req, false)
+	if got, want := req.Header.Get("Forwarded"), `for="[2001:db8::1]";host="a.test:8080";proto=http`; got != want {
+		t.Errorf("Forwarded %s, want %s", got, want)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	backend := headerBackend(t)
+	_, front := newFront(t, "route app.test "+backend.URL+" "+strings.Join([]string{
+		"req-set=X-Env:a", "req-add=X-Env:b",
+		"req-add=X-Drop:1", "req-del=X-Drop",
+		// rules come after the forwarding headers and may change them
+		"req-set=X-Forwarded-Proto:https", "req-del=X-Forwarded-For",
+		"resp-del=X-Powered-By",
+		"resp-add=X-Resp:1", "resp-set=X-Resp:2", "resp-add=X-Resp:3",
+	}, " "))
+
+	got, resp := sentHeaders(t, front, http.Header{"X-Env": {"client"}, "X-Drop": {"client"}})
+	if !reflect.DeepEqual(got["X-Env"], []string{"a", "b"}) {
+		t.Errorf("X-Env %q", got["X-Env"])
+	}
+	if _, ok := got["X-Drop"]; ok {
+		t.Errorf("X-Drop %q", got["X-Drop"])
+	}
+	if got.Get("X-Forwarded-Proto") != "https" {
+		t.Errorf("X-Forwarded-Proto %q", got.Get("X-Forwarded-Proto"))
+	}
+	if _, ok := got["X-Forwarded-For"]; ok {
+		t.Errorf("X-Forwarded-For %q", got["X-Forwarded-For"])
+	}
+	// without preserve-host the backend gets its own name
+	if got.Get("Host") != strings.TrimPrefix(backend.URL, "http://") {
+		t.Errorf("Host %q", got.Get("Host"))
+	}
+	if resp.Header.Get("X-Powered-By") != "" {
+		t.Errorf("X-Powered-By %q", resp.Header.Get("X-Powered-By"))
+	}
+	if !reflect.DeepEqual(resp.Header["X-Resp"], []string{"2", "3"}) {
+		t.Errorf("X-Resp %q", resp.Header["X-Resp"])
+	}
+
+	_, front = newFront(t, "route app.test "+backend.URL+" preserve-host=true")
+	if got, _ = sentHeaders(t, front, nil); got.Get("Host") != "app.test" {
+		t.Errorf("preserved Host %q", got.Get("Host"))
+	}
+}
+
+func TestParseHeaderRule(t *testing.T) {
+	tests := []struct {
+		op, value string
+		err       bool
+	}{
+		{HeaderSet, "x-env:dev", false},
+		{HeaderAdd, "X-Empty:", false},
+		{HeaderDel, "X-Env", false},
+		{HeaderSet, "X-Env", true},
+		{HeaderDel, "X-Env:dev", true},
+		{HeaderAdd, ":dev", true},
+	}
+	for _, tt := range tests {
+		rule, err := parseHeaderRule(tt.op, tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("%s %q: error %v", tt.op, tt.value, err)
+		}
+		if err == nil && rule.Name != http.CanonicalHeaderKey(rule.Name) {
+			t.Errorf("%s %q: name %q", tt.op, tt.value, rule.Name)
+		}
+	}
+	if _, err := parseTrust([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid trust CIDR parsed")
+	}
+}
@@ -0,0 +1,202 @@
+package reverse
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The entries ModifyHost adds are kept between these lines, the begin
+// line carrying the pid of the process that wrote them.
+const (
+	hostsBegin = "# BEGIN proxy reverse"
+	hostsEnd   = "# END proxy reverse"
+)
+
+// DefaultHostsFile is used when ReverseServer.HostsFile is empty.
+const DefaultHostsFile = "/etc/hosts"
+
+func (r *ReverseServer) hostsFile() string {
+	if r.HostsFile == "" {
+		return DefaultHostsFile
+	}
+	return r.HostsFile
+}
+
+func (r *ReverseServer) hostsAddrs() []string {
+	if len(r.HostsAddrs) == 0 {
+		return []string{"127.0.0.1"}
+	}
+	return r.HostsAddrs
+}
+
+// ModifyHost points the hosts of the list at the reverse server in a
+// marked block of the hosts file. Blocks left by processes that are no
+// longer running are removed first.
+func (r *ReverseServer) ModifyHost() error {
+	for _, addr := range r.hostsAddrs() {
+		if net.ParseIP(addr) == nil {
+			return errors.New("invalid hosts address " + addr)
+		}
+	}
+	name := r.hostsFile()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	// our own block is replaced, not stale
+	out, _ := stripHostsBlocks(data, func(pid int) bool {
+		return pid != os.Getpid()
+	})
+	out, stale := stripHostsBlocks(out, processAlive)
+	if stale > 0 {
+		fmt.Println("Removed", stale, "stale block(s) from", name)
+	}
+	var hosts []string
+	if r.on {
+		hosts = r.Hosts()
+	}
+	if len(hosts) > 0 {
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%s pid=%d\n", hostsBegin, os.Getpid())
+		for _, host := range hosts {
+			for _, addr := range r.hostsAddrs() {
+				fmt.Fprintf(&b, "%s %s\n", addr, host)
+			}
+		}
+		b.WriteString(hostsEnd + "\n")
+		out = append(out, b.Bytes()...)
+	}
+	if bytes.Equal(out, data) {
+		return nil
+	}
+	return writeFileAtomic(name, out)
+}
+
+// RestoreHost removes the block ModifyHost added.
+func (r *ReverseServer) RestoreHost() {
+	name := r.hostsFile()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		fmt.Println("Failed to restore hosts:", err)
+		return
+	}
+	out, removed := stripHostsBlocks(data, func(pid int) bool {
+		return pid != os.Getpid()
+	})
+	if removed == 0 {
+		return
+	}
+	if err = writeFileAtomic(name, out); err != nil {
+		fmt.Println("Failed to restore hosts:", err)
+	}
+}
+
+// stripHostsBlocks removes the marked blocks for which keep returns
+// false and reports how many it removed. A block without an end line is
+// left as it is but for its begin line, so no other entries are lost.
+func stripHostsBlocks(data []byte, keep func(pid int) bool) ([]byte, int) {
+	var out bytes.Buffer
+	removed := 0
+	lines := splitLines(data)
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, hostsBegin) {
+			out.WriteString(line)
+			continue
+		}
+		pid, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(trimmed, hostsBegin)), "pid="))
+		if keep(pid) {
+			out.WriteString(line)
+			continue
+		}
+		end := -1
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimSpace(lines[j]) == hostsEnd {
+				end = j
+				break
+			}
+		}
+		removed++
+		if end >= 0 {
+			i = end
+		}
+	}
+	return out.Bytes(), removed
+}
+
+// splitLines splits data after each newline, keeping them.
+func splitLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return i + 1, data[:i+1], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// writeFileAtomic replaces name with data through a temporary file and a
+// rename, keeping its mode. Only where name cannot be replaced, as with a
+// hosts file bind-mounted into a container, is it rewritten in place; any
+// other failure leaves name untouched.
+func writeFileAtomic(name string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), name)
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EXDEV) {
+		return os.WriteFile(name, data, mode)
+	}
+	return err
+}
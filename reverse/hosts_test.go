@@ -0,0 +1,83 @@
+package reverse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModifyRestoreHost(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "hosts")
+	original := "127.0.0.1 localhost\n::1 localhost\n"
+	// a block left by a process that is gone
+	stale := hostsBegin + " pid=999999999\n127.0.0.1 old.test\n" + hostsEnd + "\n"
+	if err := os.WriteFile(name, []byte(original+stale), 0640); err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(t.TempDir(), "reverseList.db")
+	if err := os.WriteFile(list, []byte("ON\napp.test 127.0.0.1:3000\nroute *.wild.test 127.0.0.1:3001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := ReverseServer{HostsFile: name, HostsAddrs: []string{"127.0.0.1", "::1"}}
+	if err := r.ParseList(list); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.ModifyHost(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(name)
+	want := original + fmt.Sprintf("%s pid=%d\n127.0.0.1 app.test\n::1 app.test\n%s\n", hostsBegin, os.Getpid(), hostsEnd)
+	if string(data) != want {
+		t.Errorf("after ModifyHost:\n%s\nwant:\n%s", data, want)
+	}
+	// running it again leaves the file as it is
+	if err := r.ModifyHost(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(name); string(again) != want {
+		t.Errorf("second ModifyHost changed the file:\n%s", again)
+	}
+
+	r.RestoreHost()
+	data, _ = os.ReadFile(name)
+	if string(data) != original {
+		t.Errorf("after RestoreHost:\n%s\nwant:\n%s", data, original)
+	}
+	if info, _ := os.Stat(name); info.Mode().Perm() != 0640 {
+		t.Errorf("mode %v, want 0640", info.Mode().Perm())
+	}
+}
+
+func TestStripHostsBlocksUnterminated(t *testing.T) {
+	data := "a\n" + hostsBegin + " pid=1\n127.0.0.1 kept.test\n"
+	out, removed := stripHostsBlocks([]byte(data), func(int) bool { return false })
+	if removed != 1 || strings.Contains(string(out), hostsBegin) || !strings.Contains(string(out), "kept.test") {
+		t.Errorf("got %q, %d removed", out, removed)
+	}
+}
+
+func TestWriteFileAtomicLeavesFileOnError(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(name, []byte("original\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a temporary file cannot be created in a missing directory; the
+	// original must not be rewritten in place
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "hosts"), []byte("new\n")); err == nil {
+		t.Error("no error")
+	}
+	if err := writeFileAtomic(name, []byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(name); string(data) != "new\n" {
+		t.Errorf("got %q", data)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+}
@@ -2,24 +2,43 @@ package reverse
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httputil"
 	"os"
-	"proxy/base"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ReverseServer struct {
-	on       bool
-	listener net.Listener
-	host     string
-	port     uint16
-	list     map[string]string
-	hostsize int64
+	// HostsFile is the hosts file ModifyHost edits, DefaultHostsFile if
+	// empty. HostsAddrs are the addresses hosts are pointed at, 127.0.0.1
+	// if empty.
+	HostsFile  string
+	HostsAddrs []string
+
+	on          bool
+	listener    net.Listener
+	proxy       *httputil.ReverseProxy
+	transport   *http.Transport
+	routes      []*Route
+	certs       []*certFile
+	issuer      *issuer
+	passthrough []*passthrough
+	cache       *Cache
+	trusted     []*net.IPNet
+	once        sync.Once
+	server      *http.Server
 }
 
+// ParseList reads "ON" or "OFF" followed by lines of "host target" pairs,
+// which proxy every request for host to target, route lines as described
+// at Route, the cert, ca and passthrough lines of the TLS listener, the
+// cache line described at Cache and the trust lines of parseTrust.
 func (r *ReverseServer) ParseList(name string) error {
 	f, err := os.Open(name)
 	if err != nil {
@@ -27,28 +46,121 @@ func (r *ReverseServer) ParseList(name string) error {
 	}
 	defer f.Close()
 
-	r.list = make(map[string]string)
+	r.routes, r.certs, r.issuer, r.passthrough, r.cache, r.trusted = nil, nil, nil, nil, nil, nil
 	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanWords)
-
-	scanner.Scan()
-	state := scanner.Text()
-	if state == "ON" {
-		r.on = true
-	} else if state == "OFF" {
-		r.on = false
-	} else {
+	first := true
+	for scanner.Scan() {
+		words := strings.Fields(scanner.Text())
+		if first && len(words) > 0 {
+			first = false
+			if words[0] == "ON" {
+				r.on = true
+			} else if words[0] == "OFF" {
+				r.on = false
+			} else {
+				return errors.New("first word should be \"ON\" or \"OFF\"")
+			}
+			words = words[1:]
+		}
+		if len(words) > 0 && words[0] == "route" {
+			rt, err := ParseRoute(words[1:])
+			if err != nil {
+				return err
+			}
+			r.routes = append(r.routes, rt)
+			continue
+		}
+		if len(words) > 0 && words[0] == "cert" {
+			c, err := parseCert(words[1:])
+			if err != nil {
+				return err
+			}
+			r.certs = append(r.certs, c)
+			continue
+		}
+		if len(words) > 0 && words[0] == "ca" {
+			r.issuer, err = parseIssuer(words[1:])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if len(words) > 0 && words[0] == "cache" {
+			r.cache, err = parseCache(words[1:])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if len(words) > 0 && words[0] == "trust" {
+			nets, err := parseTrust(words[1:])
+			if err != nil {
+				return err
+			}
+			r.trusted = append(r.trusted, nets...)
+			continue
+		}
+		if len(words) > 0 && words[0] == "passthrough" {
+			p, err := parsePassthrough(words[1:])
+			if err != nil {
+				return err
+			}
+			r.passthrough = append(r.passthrough, p)
+			continue
+		}
+		for i := 0; i < len(words); i += 2 {
+			if i+1 == len(words) {
+				return errors.New("missing target for " + words[i])
+			}
+			rt, err := ParseRoute(words[i : i+2])
+			if err != nil {
+				return err
+			}
+			r.routes = append(r.routes, rt)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if first {
 		return errors.New("first word should be \"ON\" or \"OFF\"")
 	}
+	for _, rt := range r.routes {
+		if rt.Cache {
+			if r.cache == nil {
+				return errors.New("route for " + rt.Host + " caches but there is no cache line")
+			}
+			rt.cache = r.cache
+		}
+	}
+	sortRoutes(r.routes)
+	return nil
+}
 
-	for scanner.Scan() {
-		word := scanner.Text()
-		scanner.Scan()
-		next := scanner.Text()
-		r.list[word] = next
+// Hosts returns the names routes and passthrough entries match, without
+// wildcards.
+func (r *ReverseServer) Hosts() []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	add := func(host string) {
+		if strings.HasPrefix(host, "*") || seen[host] {
+			return
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	for _, rt := range r.routes {
+		add(rt.Host)
+	}
+	for _, p := range r.passthrough {
+		add(p.host)
 	}
+	return hosts
+}
 
-	return nil
+// Enabled reports whether the parsed list starts with ON.
+func (r *ReverseServer) Enabled() bool {
+	return r.on
 }
 
 func (r *ReverseServer) Listen(addr string) {
@@ -60,94 +172,109 @@ func (r *ReverseServer) Listen(addr string) {
 	if err != nil {
 		fmt.Println("Reverse server failed to listen:", err)
 		r.on = false
-		r.listener.Close()
 		return
 	}
 	defer r.listener.Close()
-	portStr := ""
-	r.host, portStr, _ = net.SplitHostPort(addr)
-	port, _ := strconv.Atoi(portStr)
-	r.port = uint16(port)
+	r.setup()
 	fmt.Println("Reverse server is listening on", addr)
-	r.reserveListen()
+	err = r.server.Serve(r.listener)
+	fmt.Println("Reverse server stopped:", err)
 }
 
-func (r *ReverseServer) ModifyHost() (err error) {
-	f, err := os.OpenFile("/etc/hosts", os.O_APPEND|os.O_RDWR, 0666)
-	if err != nil {
-		return
-	}
-	info, err := f.Stat()
-	if err != nil {
-		return
-	}
-	r.hostsize = info.Size()
-	for key := range r.list {
-		towrite := "127.0.0.1 " + key + "\n"
-		_, err = f.Write([]byte(towrite))
-		if err != nil {
-			return
+// setup creates the proxy and HTTP server shared by the listeners and
+// starts health checks.
+func (r *ReverseServer) setup() {
+	r.once.Do(func() {
+		transport := newTransport()
+		r.transport = transport
+		r.proxy = &httputil.ReverseProxy{
+			Director:       r.direct,
+			Transport:      &cacheTransport{next: &balancer{transport: transport}},
+			ModifyResponse: modifyResponse,
+			ErrorHandler:   proxyError,
 		}
-	}
-	return
+		for _, rt := range r.routes {
+			if rt.Pool.CheckPath != "" {
+				go rt.Pool.healthCheck(context.Background(), transport)
+			}
+		}
+		r.server = &http.Server{
+			Handler:           r,
+			ReadHeaderTimeout: 30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+		}
+	})
 }
 
-func (r *ReverseServer) RestoreHost() {
-	f, _ := os.OpenFile("/etc/hosts", os.O_RDWR, 0666)
-	err := f.Truncate(r.hostsize)
-	if err != nil {
-		fmt.Println(err)
+type routeKey struct{}
+
+// ServeHTTP proxies requests to the backend of the first matching route.
+// Upgrade requests are relayed as described at upgrade.
+func (r *ReverseServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rt := r.route(req)
+	if rt == nil {
+		http.Error(w, "no route for "+req.Host+req.URL.Path, http.StatusBadGateway)
 		return
 	}
+	ctx := context.WithValue(req.Context(), routeKey{}, rt)
+	if isUpgrade(req) {
+		r.upgrade(w, req.WithContext(ctx), rt)
+		return
+	}
+	r.proxy.ServeHTTP(w, req.WithContext(ctx))
 }
 
-func (r *ReverseServer) reserveListen() {
-	for {
-		conn, err := r.listener.Accept()
-		if err != nil {
-			fmt.Println("Failed to accept request:", err)
+func (r *ReverseServer) route(req *http.Request) *Route {
+	for _, rt := range r.routes {
+		if rt.Match(req) {
+			return rt
 		}
-		go r.handleRequest(conn)
 	}
+	return nil
 }
 
-func (r *ReverseServer) handleRequest(conn net.Conn) {
-	var buf [1024]byte
-	n, _ := conn.Read(buf[:1024])
-	if !strings.Contains(string(buf[:n]), "HTTP") {
-		conn.Close()
-		fmt.Println("Reverse server only supports HTTP")
-		return
+func (r *ReverseServer) direct(req *http.Request) {
+	// the balancer fills in the backend
+	rt := req.Context().Value(routeKey{}).(*Route)
+	req.URL.Path = rt.path(req.URL.Path)
+	req.URL.RawPath = ""
+	forwardHeaders(req, trusts(r.trusted, req.RemoteAddr))
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// keep net/http from adding its own
+		req.Header.Set("User-Agent", "")
 	}
+}
 
-	goal := ""
-	var tosend []byte
-	line := ""
-	for i := 0; i < n; i++ {
-		if buf[i] != '\r' && buf[i] != '\n' {
-			line = line + string(buf[i])
-			continue
-		}
-		if strings.Contains(line, "Host: ") {
-			v, ok := r.list[line[6:]]
-			if ok {
-				line = "Host: " + v
-				goal = v + ":80"
-			}
-		}
-		line = line + string(buf[i])
-		tosend = append(tosend, line...)
-		line = ""
+func modifyResponse(resp *http.Response) error {
+	rt := resp.Request.Context().Value(routeKey{}).(*Route)
+	rt.ResponseHeaders.apply(resp.Header)
+	return nil
+}
+
+func newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		ExpectContinueTimeout: time.Second,
 	}
-	tosend = append(tosend, line...)
+}
 
-	dest, err := net.Dial("tcp", goal)
-	if err != nil {
-		conn.Close()
-		dest.Close()
-		fmt.Println("Reverse server:", err)
-		return
+// proxyError answers 504 when the backend timed out, 503 when there was
+// none to try and 502 otherwise.
+func proxyError(w http.ResponseWriter, req *http.Request, err error) {
+	fmt.Println("Reverse server:", err)
+	status := http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, errNoBackend) {
+		status = http.StatusServiceUnavailable
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		status = http.StatusGatewayTimeout
 	}
-	dest.Write(tosend)
-	base.Forward(conn, dest)
+	http.Error(w, http.StatusText(status), status)
 }
@@ -0,0 +1,201 @@
+package reverse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newList parses list, the lines after ON, and sets the server up.
+func newList(t *testing.T, list string) *ReverseServer {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "reverseList.db")
+	if err := os.WriteFile(name, []byte("ON\n"+list+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &ReverseServer{}
+	if err := r.ParseList(name); err != nil {
+		t.Fatal(err)
+	}
+	r.setup()
+	return r
+}
+
+// newFront serves the reverse server of list on a test listener.
+func newFront(t *testing.T, list string) (*ReverseServer, *httptest.Server) {
+	t.Helper()
+	r := newList(t, list)
+	front := httptest.NewServer(r)
+	t.Cleanup(front.Close)
+	return r, front
+}
+
+// do sends a request for host through front.
+func do(t *testing.T, front *httptest.Server, method, host, path string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, front.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	resp, err := front.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestProxyErrorStatus(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	r, front := newFront(t, "route slow.test "+slow.URL+" retries=0\n"+
+		"route closed.test "+closed.URL+" retries=0")
+	r.transport.ResponseHeaderTimeout = 200 * time.Millisecond
+
+	tests := []struct {
+		host   string
+		status int
+	}{
+		{"slow.test", http.StatusGatewayTimeout},
+		{"closed.test", http.StatusBadGateway},
+		// no route at all
+		{"other.test", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		if resp := do(t, front, "GET", tt.host, "/"); resp.StatusCode != tt.status {
+			t.Errorf("%s: status %s, want %d", tt.host, resp.Status, tt.status)
+		}
+	}
+}
+
+func TestProxyExpectContinue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			// refuse without reading the body
+			http.Error(w, "no", http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "expect=%q body=%q", r.Header.Get("Expect"), body)
+	}))
+	defer backend.Close()
+	_, front := newFront(t, "route app.test "+backend.URL)
+
+	send := func(auth string) (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "POST /upload HTTP/1.1\r\nHost: app.test\r\n%sContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", auth)
+		return c, bufio.NewReader(c)
+	}
+
+	t.Run("continue", func(t *testing.T) {
+		c, br := send("Authorization: x\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusContinue {
+			t.Fatalf("status %s before the body, want 100", resp.Status)
+		}
+		io.WriteString(c, "hello")
+		if resp, err = http.ReadResponse(br, nil); err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if want := `expect="100-continue" body="hello"`; string(body) != want {
+			t.Errorf("backend saw %s, want %s", body, want)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		// the final answer comes without the body being sent
+		_, br := send("")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status %s, want 401", resp.Status)
+		}
+	})
+}
+
+func TestProxyKeepAlive(t *testing.T) {
+	var backendConns, frontConns int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&backendConns, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	front := httptest.NewUnstartedServer(newList(t, "route app.test "+backend.URL))
+	front.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&frontConns, 1)
+		}
+	}
+	front.Start()
+	defer front.Close()
+
+	for i := 0; i < 5; i++ {
+		path := fmt.Sprintf("/%d", i)
+		resp := do(t, front, "GET", "app.test", path)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != path {
+			t.Fatalf("body %q, want %q", body, path)
+		}
+	}
+	if n := atomic.LoadInt32(&frontConns); n != 1 {
+		t.Errorf("client opened %d connections, want 1", n)
+	}
+	if n := atomic.LoadInt32(&backendConns); n != 1 {
+		t.Errorf("proxy opened %d backend connections, want 1", n)
+	}
+}
+
+func TestParseListErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"MAYBE\n",
+		"ON\na.test\n",
+		"ON\nroute a.test 127.0.0.1:1 cache=true\n",
+		"ON\nroute a.test 127.0.0.1:1 color=red\n",
+	}
+	for _, list := range tests {
+		name := filepath.Join(t.TempDir(), "reverseList.db")
+		if err := os.WriteFile(name, []byte(list), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var r ReverseServer
+		if err := r.ParseList(name); err == nil {
+			t.Errorf("%q parsed", strings.TrimSpace(list))
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package reverse
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route sends matching requests to a backend. A route line in
+// reverseList.db reads
+//
+//	route <host> <backend> [key=value ...]
+//
+// where host is a name, "*.name" for its subdomains or "*" for any, and
+// backend is "[scheme://]host[:port][/path]", http on its default port
+// when left out, with the path put before the request's. Several backends
+// may be listed as described at Pool. The keys are
+//
+//	path=/api        path prefix to match
+//	regex=^/v[0-9]+/ path regexp to match, instead of path
+//	method=GET,HEAD  methods to match
+//	header=X-Env:dev header to match, without a value it only has to be
+//	                 present; may be repeated
+//	strip=/api       prefix removed from the path before proxying
+//	rewrite=/v2/     replacement for the part matched by path or regex,
+//	                 regex groups may be used as $1
+//	priority=10      routes are tried from the highest priority, then in
+//	                 file order
+//	preserve-host=true
+//	                 send the client's Host header instead of the backend's
+//	cache=true       keep responses in the cache described at Cache
+//	upgrade-idle=5m  how long WebSocket and other upgraded connections may
+//	                 stay idle
+//	req-set=X-Env:dev
+//	                 header rules for requests, and with resp- for
+//	                 responses, as described at HeaderRule; applied in
+//	                 order after the X-Forwarded-* and Forwarded headers
+//
+// along with the keys of Pool.
+type Route struct {
+	Host     string
+	Prefix   string
+	Regex    *regexp.Regexp
+	Methods  []string
+	Headers  []HeaderMatch
+	Pool     *Pool
+	Strip    string
+	Rewrite  *string
+	Priority int
+
+	PreserveHost    bool
+	UpgradeIdle     time.Duration
+	RequestHeaders  HeaderRules
+	ResponseHeaders HeaderRules
+	Cache           bool
+
+	cache *Cache
+}
+
+type HeaderMatch struct {
+	Name  string
+	Value string
+}
+
+// ParseRoute parses the words after "route".
+func ParseRoute(words []string) (*Route, error) {
+	if len(words) < 2 {
+		return nil, errors.New("route needs a host and a backend")
+	}
+	pool, err := newPool(words[1])
+	if err != nil {
+		return nil, err
+	}
+	rt := &Route{Host: strings.ToLower(words[0]), Pool: pool}
+	for _, word := range words[2:] {
+		key, value, ok := strings.Cut(word, "=")
+		if !ok {
+			return nil, errors.New("expected key=value, got " + word)
+		}
+		if ok, err = pool.set(key, value); ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch key {
+		case "path":
+			rt.Prefix = value
+		case "regex":
+			rt.Regex, err = regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+		case "method":
+			rt.Methods = strings.Split(strings.ToUpper(value), ",")
+		case "header":
+			name, v, _ := strings.Cut(value, ":")
+			rt.Headers = append(rt.Headers, HeaderMatch{Name: name, Value: v})
+		case "strip":
+			rt.Strip = value
+		case "rewrite":
+			rewrite := value
+			rt.Rewrite = &rewrite
+		case "priority":
+			rt.Priority, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.New("invalid priority " + value)
+			}
+		case "preserve-host":
+			rt.PreserveHost, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.New("invalid preserve-host " + value)
+			}
+		case "cache":
+			rt.Cache, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.New("invalid cache " + value)
+			}
+		case "upgrade-idle":
+			rt.UpgradeIdle, err = time.ParseDuration(value)
+			if err != nil || rt.UpgradeIdle <= 0 {
+				return nil, errors.New("invalid upgrade-idle " + value)
+			}
+		case "req-add", "req-set", "req-del", "resp-add", "resp-set", "resp-del":
+			dir, op, _ := strings.Cut(key, "-")
+			rule, err := parseHeaderRule(op, value)
+			if err != nil {
+				return nil, err
+			}
+			if dir == "req" {
+				rt.RequestHeaders = append(rt.RequestHeaders, rule)
+			} else {
+				rt.ResponseHeaders = append(rt.ResponseHeaders, rule)
+			}
+		default:
+			return nil, errors.New("unknown route key " + key)
+		}
+	}
+	if rt.Prefix != "" && rt.Regex != nil {
+		return nil, errors.New("route has both path and regex")
+	}
+	return rt, nil
+}
+
+func parseBackend(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("unsupported backend scheme " + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("backend has no host: " + s)
+	}
+	return u, nil
+}
+
+// Match reports whether req should go to rt.
+func (rt *Route) Match(req *http.Request) bool {
+	if !matchHost(rt.Host, req.Host) {
+		return false
+	}
+	if rt.Prefix != "" && !strings.HasPrefix(req.URL.Path, rt.Prefix) {
+		return false
+	}
+	if rt.Regex != nil && !rt.Regex.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(rt.Methods) > 0 {
+		found := false
+		for _, m := range rt.Methods {
+			if m == req.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, h := range rt.Headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(h.Name)]
+		if !ok {
+			return false
+		}
+		if h.Value == "" {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			if v == h.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if pattern == "*" || pattern == host {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
+
+// path returns the path to send to the backend.
+func (rt *Route) path(p string) string {
+	if rt.Rewrite != nil {
+		if rt.Regex != nil {
+			p = rt.Regex.ReplaceAllString(p, *rt.Rewrite)
+		} else {
+			p = *rt.Rewrite + strings.TrimPrefix(p, rt.Prefix)
+		}
+	}
+	if rt.Strip != "" {
+		p = strings.TrimPrefix(p, rt.Strip)
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// sortRoutes orders routes by priority, keeping file order among equals.
+func sortRoutes(routes []*Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority > routes[j].Priority
+	})
+}
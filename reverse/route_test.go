@@ -0,0 +1,153 @@
+package reverse
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		match         bool
+	}{
+		{"a.test", "a.test", true},
+		{"a.test", "A.Test:8080", true},
+		{"a.test", "b.test", false},
+		{"*", "anything:80", true},
+		{"*.a.test", "x.a.test", true},
+		{"*.a.test", "x.y.a.test:443", true},
+		{"*.a.test", "a.test", false},
+		{"*.a.test", "xa.test", false},
+		{"*.a.test", "[::1]:80", false},
+	}
+	for _, tt := range tests {
+		if got := matchHost(tt.pattern, tt.host); got != tt.match {
+			t.Errorf("matchHost(%q, %q) = %v", tt.pattern, tt.host, got)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		line string
+		err  bool
+	}{
+		{"a.test 127.0.0.1:8080", false},
+		{"A.TEST https://b.test/base path=/api method=get,post header=X-Env:dev header=X-Debug priority=5", false},
+		{"a.test 127.0.0.1:1*2,127.0.0.1:2 lb=least-conn eject=0 retries=2", false},
+		{"a.test", true},
+		{"a.test ftp://b.test", true},
+		{"a.test http://", true},
+		{"a.test 127.0.0.1:1*0", true},
+		{"a.test 127.0.0.1:1 path", true},
+		{"a.test 127.0.0.1:1 path=/a regex=^/b", true},
+		{"a.test 127.0.0.1:1 regex=(", true},
+		{"a.test 127.0.0.1:1 priority=high", true},
+		{"a.test 127.0.0.1:1 upgrade-idle=0s", true},
+		{"a.test 127.0.0.1:1 lb=random", true},
+		{"a.test 127.0.0.1:1 rise=0", true},
+	}
+	for _, tt := range tests {
+		_, err := ParseRoute(strings.Fields(tt.line))
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.line, err)
+		}
+	}
+
+	rt, err := ParseRoute(strings.Fields("A.TEST https://b.test/base path=/api method=get,post header=X-Env:dev header=X-Debug"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.Host != "a.test" || rt.Prefix != "/api" || strings.Join(rt.Methods, ",") != "GET,POST" || len(rt.Headers) != 2 {
+		t.Errorf("parsed %+v", rt)
+	}
+	if b := rt.Pool.Backends[0]; b.URL.Scheme != "https" || b.URL.Host != "b.test" || b.URL.Path != "/base" {
+		t.Errorf("backend %v", b.URL)
+	}
+}
+
+func TestRouteSelection(t *testing.T) {
+	r := newList(t, strings.Join([]string{
+		"route *.a.test 127.0.0.1:1",
+		"route x.a.test 127.0.0.1:2",
+		"route x.a.test 127.0.0.1:3 path=/api",
+		"route x.a.test 127.0.0.1:4 path=/api method=POST priority=1",
+		"route x.a.test 127.0.0.1:5 regex=^/v[0-9]+/ header=X-Env:dev priority=1",
+		"route x.a.test 127.0.0.1:6 header=X-Debug priority=2",
+		"route * 127.0.0.1:7",
+	}, "\n"))
+
+	tests := []struct {
+		method, host, path string
+		header             []string
+		backend            string
+	}{
+		// file order among equal priorities, so the wildcard comes first
+		{"GET", "x.a.test", "/api/users", nil, "127.0.0.1:1"},
+		{"GET", "y.a.test", "/", nil, "127.0.0.1:1"},
+		{"POST", "x.a.test", "/api/users", nil, "127.0.0.1:4"},
+		{"GET", "x.a.test", "/v2/users", []string{"X-Env", "dev"}, "127.0.0.1:5"},
+		{"GET", "x.a.test", "/v2/users", []string{"X-Env", "prod"}, "127.0.0.1:1"},
+		// a header with any value
+		{"POST", "x.a.test", "/api", []string{"X-Debug", ""}, "127.0.0.1:6"},
+		{"GET", "b.test", "/", nil, "127.0.0.1:7"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, nil)
+		if tt.header != nil {
+			req.Header.Set(tt.header[0], tt.header[1])
+		}
+		rt := r.route(req)
+		if rt == nil {
+			t.Errorf("%s %s%s: no route", tt.method, tt.host, tt.path)
+			continue
+		}
+		if got := rt.Pool.Backends[0].URL.Host; got != tt.backend {
+			t.Errorf("%s %s%s %v: routed to %s, want %s", tt.method, tt.host, tt.path, tt.header, got, tt.backend)
+		}
+	}
+}
+
+func TestRoutePath(t *testing.T) {
+	tests := []struct {
+		keys string
+		path string
+		want string
+	}{
+		{"", "/a/b", "/a/b"},
+		{"path=/api", "/api/users", "/api/users"},
+		{"path=/api strip=/api", "/api/users", "/users"},
+		{"path=/api strip=/api", "/api", "/"},
+		{"path=/api rewrite=/v2", "/api/users", "/v2/users"},
+		{"path=/api rewrite=", "/api/users", "/users"},
+		{"regex=^/v([0-9]+)/ rewrite=/api/$1/", "/v3/users", "/api/3/users"},
+		{"regex=^/old rewrite=/new", "/old/old", "/new/old"},
+		// strip applies after rewrite
+		{"path=/api rewrite=/v2 strip=/v2", "/api/users", "/users"},
+	}
+	for _, tt := range tests {
+		rt, err := ParseRoute(append([]string{"a.test", "127.0.0.1:1"}, strings.Fields(tt.keys)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rt.path(tt.path); got != tt.want {
+			t.Errorf("%q: path(%q) = %q, want %q", tt.keys, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRouteBackendPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+	_, front := newFront(t, "route a.test "+backend.URL+"/base/ path=/api strip=/api")
+	resp := do(t, front, "GET", "a.test", "/api/users?id=1")
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "/base/users?id=1" {
+		t.Errorf("backend saw %s", body)
+	}
+}
@@ -0,0 +1,226 @@
+package reverse
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// cacheStore keeps cache entries by key.
+type cacheStore interface {
+	get(key string) (*cacheEntry, bool)
+	put(key string, e *cacheEntry)
+	remove(key string)
+}
+
+// lru tracks the size of what a store holds and which keys to evict to
+// stay within max.
+type lru struct {
+	max     int64
+	size    int64
+	order   *list.List // front is the most recently used
+	items   map[string]*list.Element
+	onEvict func(key string)
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *cacheEntry // memory store only
+}
+
+func newLRU(max int64, onEvict func(string)) *lru {
+	return &lru{max: max, order: list.New(), items: make(map[string]*list.Element), onEvict: onEvict}
+}
+
+func (l *lru) touch(key string) (*lruItem, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// add records item in place of any item with its key, evicting the least
+// recently used items to make room. It reports false if item is bigger
+// than the whole store, leaving neither it nor the item it replaced.
+func (l *lru) add(item *lruItem) bool {
+	l.remove(item.key)
+	if item.size > l.max {
+		return false
+	}
+	for l.size+item.size > l.max {
+		oldest := l.order.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		if l.onEvict != nil {
+			l.onEvict(oldest.key)
+		}
+	}
+	l.items[item.key] = l.order.PushFront(item)
+	l.size += item.size
+	return true
+}
+
+func (l *lru) remove(key string) {
+	if el, ok := l.items[key]; ok {
+		l.size -= el.Value.(*lruItem).size
+		l.order.Remove(el)
+		delete(l.items, key)
+	}
+}
+
+// memoryStore keeps entries in memory.
+type memoryStore struct {
+	mu  sync.Mutex
+	lru *lru
+}
+
+func newMemoryStore(max int64) *memoryStore {
+	return &memoryStore{lru: newLRU(max, nil)}
+}
+
+func (s *memoryStore) get(key string) (*cacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.lru.touch(key)
+	if !ok {
+		return nil, false
+	}
+	return item.entry, true
+}
+
+func (s *memoryStore) put(key string, e *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.add(&lruItem{key: key, size: e.size(), entry: e})
+}
+
+func (s *memoryStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.remove(key)
+}
+
+// diskStore keeps an entry per file in dir, named after the hash of its
+// key. Files found at start are taken over, oldest first to be evicted.
+type diskStore struct {
+	dir string
+	mu  sync.Mutex
+	lru *lru
+}
+
+const cacheFileSuffix = ".cache"
+
+func newDiskStore(dir string, max int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &diskStore{dir: dir}
+	s.lru = newLRU(max, func(name string) {
+		os.Remove(filepath.Join(dir, name))
+	})
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		name string
+		info os.FileInfo
+	}
+	var existing []found
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), cacheFileSuffix) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		existing = append(existing, found{f.Name(), info})
+	}
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].info.ModTime().Before(existing[j].info.ModTime())
+	})
+	for _, f := range existing {
+		if !s.lru.add(&lruItem{key: f.name, size: f.info.Size()}) {
+			os.Remove(filepath.Join(dir, f.name))
+		}
+	}
+	if len(existing) > 0 {
+		fmt.Println("Reverse cache: found", len(s.lru.items), "entries in", dir)
+	}
+	return s, nil
+}
+
+func (s *diskStore) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + cacheFileSuffix
+}
+
+func (s *diskStore) get(key string) (*cacheEntry, bool) {
+	name := s.fileName(key)
+	s.mu.Lock()
+	_, ok := s.lru.touch(name)
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		s.drop(name)
+		return nil, false
+	}
+	var stored diskEntry
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&stored); err != nil || stored.Key != key {
+		s.drop(name)
+		return nil, false
+	}
+	return &stored.Entry, true
+}
+
+func (s *diskStore) put(key string, e *cacheEntry) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&diskEntry{Key: key, Entry: *e}); err != nil {
+		fmt.Println("Reverse cache:", err)
+		return
+	}
+	name := s.fileName(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lru.add(&lruItem{key: name, size: int64(b.Len())}) {
+		// the entry it replaced must not be found again at start
+		os.Remove(filepath.Join(s.dir, name))
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, name), b.Bytes()); err != nil {
+		fmt.Println("Reverse cache:", err)
+		s.lru.remove(name)
+	}
+}
+
+func (s *diskStore) remove(key string) {
+	s.drop(s.fileName(key))
+}
+
+func (s *diskStore) drop(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.remove(name)
+	os.Remove(filepath.Join(s.dir, name))
+}
+
+// diskEntry is what a cache file holds; the key guards against hash
+// collisions.
+type diskEntry struct {
+	Key   string
+	Entry cacheEntry
+}
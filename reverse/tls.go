@@ -0,0 +1,290 @@
+package reverse
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"proxy/base"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certFile is a certificate loaded from disk for the names matching host,
+// reloaded when either file changes. In reverseList.db it reads
+//
+//	cert <host> <cert.pem> <key.pem>
+//
+// where host may be a name, "*.name" or "*" for any other name.
+type certFile struct {
+	host     string
+	certPath string
+	keyPath  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// passthrough forwards TLS connections for host to addr without
+// decrypting them. In reverseList.db it reads
+//
+//	passthrough <host> <addr>
+type passthrough struct {
+	host string
+	addr string
+}
+
+// reloadCheck is how often certificate files are checked for changes.
+const reloadCheck = 2 * time.Second
+
+func parseCert(words []string) (*certFile, error) {
+	if len(words) != 3 {
+		return nil, errors.New("cert needs a host, a certificate and a key")
+	}
+	c := &certFile{host: strings.ToLower(words[0]), certPath: words[1], keyPath: words[2]}
+	if _, err := c.get(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parsePassthrough(words []string) (*passthrough, error) {
+	if len(words) != 2 {
+		return nil, errors.New("passthrough needs a host and an address")
+	}
+	if _, _, err := net.SplitHostPort(words[1]); err != nil {
+		return nil, err
+	}
+	return &passthrough{host: strings.ToLower(words[0]), addr: words[1]}, nil
+}
+
+// get returns the certificate, reloading it if the files changed. A
+// failed reload keeps the previous certificate.
+func (c *certFile) get() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.cert != nil && now.Sub(c.checked) < reloadCheck {
+		return c.cert, nil
+	}
+	c.checked = now
+	modTime, err := latestModTime(c.certPath, c.keyPath)
+	if err == nil && c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(c.certPath, c.keyPath)
+		if err == nil {
+			if c.cert != nil {
+				fmt.Println("Reverse server: reloaded certificate", c.certPath)
+			}
+			c.cert, c.modTime = &cert, modTime
+			return c.cert, nil
+		}
+	}
+	if c.cert != nil {
+		fmt.Println("Reverse server: keeping old certificate:", err)
+		return c.cert, nil
+	}
+	return nil, err
+}
+
+func latestModTime(names ...string) (time.Time, error) {
+	var latest time.Time
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// TLSEnabled reports whether the list has certificates, a CA or
+// passthrough hosts, so a TLS listener is of use.
+func (r *ReverseServer) TLSEnabled() bool {
+	return r.on && (len(r.certs) > 0 || r.issuer != nil || len(r.passthrough) > 0)
+}
+
+// getCertificate picks the certificate for the server name of hello: an
+// exact match, then a wildcard, then one issued by the CA, then "*".
+func (r *ReverseServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	var best *certFile
+	for _, c := range r.certs {
+		if c.host == name {
+			best = c
+			break
+		}
+		if matchHost(c.host, name) && (best == nil || best.host == "*") {
+			best = c
+		}
+	}
+	if r.issuer != nil && (best == nil || best.host == "*") {
+		if issue, ok := r.issueName(name); ok {
+			return r.issuer.get(issue)
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no certificate for " + name)
+	}
+	return best.get()
+}
+
+func (r *ReverseServer) passthroughAddr(name string) (string, bool) {
+	for _, p := range r.passthrough {
+		if matchHost(p.host, name) {
+			return p.addr, true
+		}
+	}
+	return "", false
+}
+
+// ListenTLS accepts TLS on addr. Connections whose server name has a
+// passthrough entry are relayed as they are, the others are terminated
+// and served like plain HTTP.
+func (r *ReverseServer) ListenTLS(addr string) {
+	if !r.TLSEnabled() {
+		return
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("Reverse server failed to listen for TLS:", err)
+		return
+	}
+	defer l.Close()
+	fmt.Println("Reverse server (TLS) is listening on", addr)
+	r.serveTLS(l)
+}
+
+// serveTLS serves the TLS connections of l until it is closed.
+func (r *ReverseServer) serveTLS(l net.Listener) {
+	r.setup()
+	conf := &tls.Config{
+		GetCertificate: r.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+	terminated := newConnListener(l.Addr())
+	defer terminated.Close()
+	go r.server.Serve(terminated)
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println("Failed to accept request:", err)
+			continue
+		}
+		go r.handleTLS(conn, conf, terminated)
+	}
+}
+
+func (r *ReverseServer) handleTLS(conn net.Conn, conf *tls.Config, terminated *connListener) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	name, hello, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		fmt.Println("Reverse server: reading ClientHello:", err)
+		conn.Close()
+		return
+	}
+	conn = &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}
+	if addr, ok := r.passthroughAddr(name); ok {
+		dest, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		if err != nil {
+			fmt.Println("Reverse server:", err)
+			conn.Close()
+			return
+		}
+		base.Forward(conn, dest)
+		return
+	}
+	terminated.put(tls.Server(conn, conf))
+}
+
+var errHelloRead = errors.New("hello read")
+
+// peekServerName reads the ClientHello from conn and returns its server
+// name along with the bytes read, which must be replayed to the real
+// handshake.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var name string
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return strings.ToLower(name), buf.Bytes(), nil
+}
+
+// readOnlyConn lets a TLS handshake read the ClientHello but not answer.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                { return nil }
+
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// connListener hands connections accepted elsewhere to an http.Server.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) put(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,226 @@
+package reverse
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for host with common name cn
+// and returns the certificate and key paths.
+func writeCert(t *testing.T, dir, host, cn string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.NewReplacer("*", "star").Replace(host)
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// tlsFront serves the TLS listener of list and returns its address.
+func tlsFront(t *testing.T, list string) (*ReverseServer, string) {
+	t.Helper()
+	r := newList(t, list)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go r.serveTLS(l)
+	return r, l.Addr().String()
+}
+
+// dialName does a TLS handshake with addr for name and returns the
+// connection and the common name of the certificate served.
+func dialName(t *testing.T, addr, name string) (*tls.Conn, string) {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, c.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func getOver(t *testing.T, c net.Conn, host string) string {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestListenTLS(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "terminated")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "passthrough")
+	}))
+	defer secure.Close()
+
+	dir := t.TempDir()
+	certPath, keyPath := writeCert(t, dir, "app.test", "app")
+	_, addr := tlsFront(t, strings.Join([]string{
+		"route app.test " + plain.URL,
+		"cert app.test " + certPath + " " + keyPath,
+		"passthrough pass.test " + secure.Listener.Addr().String(),
+	}, "\n"))
+
+	c, cn := dialName(t, addr, "app.test")
+	if cn != "app" {
+		t.Errorf("app.test served %q", cn)
+	}
+	if body := getOver(t, c, "app.test"); body != "terminated" {
+		t.Errorf("app.test answered %q", body)
+	}
+
+	// the backend's own certificate comes through
+	c, _ = dialName(t, addr, "pass.test")
+	if !c.ConnectionState().PeerCertificates[0].Equal(secure.Certificate()) {
+		t.Error("pass.test was not relayed to its backend")
+	}
+	if body := getOver(t, c, "pass.test"); body != "passthrough" {
+		t.Errorf("pass.test answered %q", body)
+	}
+
+	// no ClientHello at all
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(raw, "GET / HTTP/1.1\r\nHost: app.test\r\n\r\n")
+	if _, err := raw.Read(make([]byte, 1)); err == nil {
+		t.Error("plain HTTP got an answer on the TLS listener")
+	}
+}
+
+func TestCertificateSelection(t *testing.T) {
+	dir := t.TempDir()
+	var lines []string
+	// most general first, so file order cannot be what picks
+	for _, host := range []string{"*", "*.a.test", "a.test", "x.a.test"} {
+		certPath, keyPath := writeCert(t, dir, host, host)
+		lines = append(lines, "cert "+host+" "+certPath+" "+keyPath)
+	}
+	r := newList(t, strings.Join(lines, "\n"))
+
+	tests := []struct {
+		name, cn string
+	}{
+		{"a.test", "a.test"},
+		{"A.TEST", "a.test"},
+		{"x.a.test", "x.a.test"},
+		{"y.a.test", "*.a.test"},
+		{"b.test", "*"},
+		{"", "*"},
+	}
+	for _, tt := range tests {
+		cert, err := r.getCertificate(&tls.ClientHelloInfo{ServerName: tt.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName != tt.cn {
+			t.Errorf("%q got the certificate of %q, want %q", tt.name, leaf.Subject.CommonName, tt.cn)
+		}
+	}
+
+	r = newList(t, lines[1])
+	if _, err := r.getCertificate(&tls.ClientHelloInfo{ServerName: "b.test"}); err == nil {
+		t.Error("b.test got a certificate without a \"*\" entry")
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+	dir := t.TempDir()
+	certPath, keyPath := writeCert(t, dir, "app.test", "old")
+	r, addr := tlsFront(t, "route app.test "+backend.URL+"\ncert app.test "+certPath+" "+keyPath)
+
+	if _, cn := dialName(t, addr, "app.test"); cn != "old" {
+		t.Fatalf("served %q", cn)
+	}
+
+	writeCert(t, dir, "app.test", "new")
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{certPath, keyPath} {
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// within reloadCheck the files are not looked at
+	if _, cn := dialName(t, addr, "app.test"); cn != "old" {
+		t.Errorf("served %q before the reload check", cn)
+	}
+	c := r.certs[0]
+	c.mu.Lock()
+	c.checked = time.Time{}
+	c.mu.Unlock()
+	if _, cn := dialName(t, addr, "app.test"); cn != "new" {
+		t.Errorf("served %q after the files changed", cn)
+	}
+
+	// a broken file keeps the loaded certificate
+	if err := os.WriteFile(certPath, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	c.mu.Lock()
+	c.checked = time.Time{}
+	c.mu.Unlock()
+	if _, cn := dialName(t, addr, "app.test"); cn != "new" {
+		t.Errorf("served %q after a failed reload", cn)
+	}
+}
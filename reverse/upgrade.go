@@ -0,0 +1,237 @@
+package reverse
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUpgradeIdle is how long an upgraded connection may go without
+// traffic in either direction before it is closed.
+const DefaultUpgradeIdle = 5 * time.Minute
+
+// isUpgrade reports whether req asks to switch protocols, as WebSocket and
+// h2c clients do.
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade sends an Upgrade request to a backend of rt itself. If the
+// backend switches protocols the client connection is hijacked and bytes
+// are relayed both ways until either side closes or the connection goes
+// idle; any other answer is passed on as a plain response.
+func (r *ReverseServer) upgrade(w http.ResponseWriter, req *http.Request, rt *Route) {
+	out := req.Clone(req.Context())
+	r.direct(out)
+	appendForwardedFor(out)
+	removeHopHeaders(out.Header)
+	out.RequestURI = ""
+
+	p := rt.Pool
+	tried := make(map[*Backend]bool)
+	var b *Backend
+	var backend net.Conn
+	for attempt := 0; ; attempt++ {
+		b = p.pick(req, tried)
+		if b == nil {
+			proxyError(w, req, errNoBackend)
+			return
+		}
+		tried[b] = true
+		var err error
+		backend, err = dialBackend(req.Context(), r.transport, b)
+		p.report(b, err != nil)
+		if err == nil {
+			break
+		}
+		if attempt >= p.Retries || len(tried) == len(p.Backends) {
+			proxyError(w, req, err)
+			return
+		}
+		fmt.Println("Reverse server: retrying upgrade after backend", b.URL.Host, "failed:", err)
+	}
+	defer backend.Close()
+	atomic.AddInt64(&b.active, 1)
+	defer atomic.AddInt64(&b.active, -1)
+
+	out.URL.Scheme = b.URL.Scheme
+	out.URL.Host = b.URL.Host
+	out.URL.Path = strings.TrimSuffix(b.URL.Path, "/") + out.URL.Path
+	if !rt.PreserveHost {
+		out.Host = b.URL.Host
+	}
+	rt.RequestHeaders.apply(out.Header)
+
+	backend.SetDeadline(time.Now().Add(time.Minute))
+	if err := out.Write(backend); err != nil {
+		proxyError(w, req, err)
+		return
+	}
+	br := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		proxyError(w, req, err)
+		return
+	}
+	defer resp.Body.Close()
+	backend.SetDeadline(time.Time{})
+	rt.ResponseHeaders.apply(resp.Header)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		proxyError(w, req, errors.New("connection cannot be hijacked"))
+		return
+	}
+	client, brw, err := hj.Hijack()
+	if err != nil {
+		fmt.Println("Reverse server:", err)
+		return
+	}
+	defer client.Close()
+	client.SetDeadline(time.Time{})
+	// the response is written as it came so Connection and Upgrade stay
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err = brw.Flush(); err != nil {
+		return
+	}
+	idle := rt.UpgradeIdle
+	if idle == 0 {
+		idle = DefaultUpgradeIdle
+	}
+	relay(client, brw.Reader, backend, br, idle)
+}
+
+// removeHopHeaders removes the hop-by-hop headers of an Upgrade request,
+// those listed in Connection included, but for what the upgrade needs:
+// Upgrade, and HTTP2-Settings for h2c.
+func removeHopHeaders(h http.Header) {
+	keep := map[string]bool{"Upgrade": true}
+	if strings.EqualFold(h.Get("Upgrade"), "h2c") {
+		keep["Http2-Settings"] = true
+	}
+	var listed []string
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if keep[name] {
+				listed = append(listed, name)
+			} else if name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range []string{"Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding"} {
+		h.Del(name)
+	}
+	h.Set("Connection", strings.Join(listed, ", "))
+}
+
+// dialBackend connects to b with the dialer and TLS settings of the
+// transport plain requests go through.
+func dialBackend(ctx context.Context, t *http.Transport, b *Backend) (net.Conn, error) {
+	addr := b.URL.Host
+	if b.URL.Port() == "" {
+		port := "80"
+		if b.URL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(b.URL.Hostname(), port)
+	}
+	if b.URL.Scheme == "https" && t.DialTLSContext != nil {
+		return t.DialTLSContext(ctx, "tcp", addr)
+	}
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil || b.URL.Scheme != "https" {
+		return conn, err
+	}
+	conf := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		conf = t.TLSClientConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = b.URL.Hostname()
+	}
+	// the upgrade is an HTTP/1.1 exchange
+	conf.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, conf)
+	if t.TLSHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.TLSHandshakeTimeout)
+		defer cancel()
+	}
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// relay copies between a and b, reading through ar and br which may hold
+// bytes already read from them, until one side closes or neither sent
+// anything for idle.
+func relay(a net.Conn, ar io.Reader, b net.Conn, br io.Reader, idle time.Duration) {
+	last := time.Now().UnixNano()
+	done := make(chan struct{}, 2)
+	forwarding := func(dst, src net.Conn, r io.Reader) {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, 32*1024)
+		for {
+			src.SetReadDeadline(time.Now().Add(idle))
+			n, err := r.Read(buf)
+			if n > 0 {
+				atomic.StoreInt64(&last, time.Now().UnixNano())
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&last))) < idle {
+				// the other direction is busy
+				continue
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	go forwarding(b, a, ar)
+	go forwarding(a, b, br)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
@@ -0,0 +1,124 @@
+package reverse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoUpgrade switches to an echo protocol, first sending a line with the
+// request headers the test looks at.
+func echoUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	c, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	fmt.Fprintf(brw, "connection=%q x-drop=%q keep-alive=%q xff=%q\n",
+		r.Header.Values("Connection"), r.Header.Get("X-Drop"), r.Header.Get("Keep-Alive"), r.Header.Get("X-Forwarded-For"))
+	brw.Flush()
+	io.Copy(c, brw)
+}
+
+func upgradeServer(t *testing.T, backend *httptest.Server, route string) (*ReverseServer, *httptest.Server) {
+	t.Helper()
+	return newFront(t, "route app.test "+backend.URL+" "+route)
+}
+
+// dialUpgrade sends an Upgrade request through front and returns the
+// response and a reader positioned after it.
+func dialUpgrade(t *testing.T, front *httptest.Server, upgrade string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	c, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	fmt.Fprintf(c, "GET /ws HTTP/1.1\r\nHost: app.test\r\nConnection: keep-alive, Upgrade, X-Drop\r\nKeep-Alive: timeout=5\r\nX-Drop: 1\r\nUpgrade: %s\r\n\r\n", upgrade)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, br, resp
+}
+
+func TestUpgradeRelay(t *testing.T) {
+	for _, scheme := range []string{"http", "https"} {
+		t.Run(scheme, func(t *testing.T) {
+			var backend *httptest.Server
+			if scheme == "https" {
+				backend = httptest.NewTLSServer(http.HandlerFunc(echoUpgrade))
+			} else {
+				backend = httptest.NewServer(http.HandlerFunc(echoUpgrade))
+			}
+			defer backend.Close()
+			r, front := upgradeServer(t, backend, "upgrade-idle=300ms")
+			if scheme == "https" {
+				// upgrades must trust what plain requests trust
+				r.transport.TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+			}
+
+			c, br, resp := dialUpgrade(t, front, "echo")
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %s", resp.Status)
+			}
+			line, _ := br.ReadString('\n')
+			want := `connection=["Upgrade"] x-drop="" keep-alive="" xff="127.0.0.1"`
+			if strings.TrimSpace(line) != want {
+				t.Errorf("backend saw %s, want %s", strings.TrimSpace(line), want)
+			}
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(c, "ping %d\n", i)
+				if line, _ = br.ReadString('\n'); line != fmt.Sprintf("ping %d\n", i) {
+					t.Fatalf("echo %q", line)
+				}
+			}
+			start := time.Now()
+			if _, err := br.ReadString('\n'); err == nil {
+				t.Error("idle connection was not closed")
+			}
+			if d := time.Since(start); d > 2*time.Second {
+				t.Errorf("idle connection closed after %v", d)
+			}
+		})
+	}
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer backend.Close()
+	_, front := upgradeServer(t, backend, "")
+	_, _, resp := dialUpgrade(t, front, "other")
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("status %s, want 426", resp.Status)
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":     {"Upgrade, HTTP2-Settings, X-Other"},
+		"Upgrade":        {"h2c"},
+		"Http2-Settings": {"AAMAAABkAAQAAP__"},
+		"X-Other":        {"1"},
+		"Te":             {"trailers"},
+	}
+	removeHopHeaders(h)
+	if got := h.Get("Connection"); got != "Upgrade, Http2-Settings" {
+		t.Errorf("Connection %q", got)
+	}
+	if h.Get("Http2-Settings") == "" || h.Get("X-Other") != "" || h.Get("Te") != "" {
+		t.Errorf("headers left: %v", h)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"proxy/base"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	readyLine  = "SOCKS5 server is listening on"
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+	// a child that ran this long is considered healthy again
+	stableRun = time.Minute
+)
+
+// startServers starts one SOCKS5 server per address dialing with opts,
+// as goroutines or, if child is set, as child processes running the
+// server subcommand with child as arguments, which are restarted when they
+// crash. It returns once every server is listening, or with the first
+// startup error after stopping those already started. stop shuts all of
+// them down.
+func startServers(addrs []string, opts *base.DialOptions, child []string) (stop func(), err error) {
+	if child != nil {
+		return superviseServers(addrs, child)
+	}
+	var listeners []net.Listener
+	stop = func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		go base.ServerListenWith(l, opts)
+		fmt.Println(readyLine, addr)
+	}
+	return stop, nil
+}
+
+func superviseServers(addrs []string, child []string) (stop func(), err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	stop = func() {
+		cancel()
+		wg.Wait()
+	}
+	for _, addr := range addrs {
+		ready := make(chan error, 1)
+		args := append(append([]string{}, child...), addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			supervise(ctx, exe, args, ready)
+		}()
+		if err := <-ready; err != nil {
+			stop()
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		fmt.Println("SOCKS5 server (supervised) is listening on", addr)
+	}
+	return stop, nil
+}
+
+// supervise keeps a child server running until ctx is done. The
+// outcome of the first start is sent on ready; if the child exits before
+// it is listening it is not restarted.
+func supervise(ctx context.Context, exe string, args []string, ready chan<- error) {
+	addr := args[len(args)-1]
+	backoff := minBackoff
+	listening := false
+	for {
+		started := time.Now()
+		err := runChild(ctx, exe, args, func() {
+			if !listening {
+				listening = true
+				ready <- nil
+			}
+		})
+		if !listening {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			ready <- err
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > stableRun {
+			backoff = minBackoff
+		}
+		fmt.Printf("SOCKS5 server on %s exited: %v, restarting in %v\n", addr, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// runChild runs one child server and returns when it exits. Its output is
+// passed through, and onReady is called once it reports listening.
+func runChild(ctx context.Context, exe string, args []string, onReady func()) error {
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, readyLine) {
+			onReady()
+			continue
+		}
+		fmt.Println(line)
+	}
+	err = cmd.Wait()
+	if err == nil {
+		err = errors.New("exited")
+	}
+	return err
+}